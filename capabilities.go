@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var capabilityNames = map[CapabilityType]string{
+	CapVolumes:                            "VOLUMES",
+	CapVolumeCreate:                       "VOLUME_CREATE",
+	CapVolumeCResize:                      "VOLUME_RESIZE",
+	CapVolumeCReplicate:                   "VOLUME_REPLICATE",
+	CapVolumeCReplicateClone:              "VOLUME_REPLICATE_CLONE",
+	CapVolumeCReplicateCopy:               "VOLUME_REPLICATE_COPY",
+	CapVolumeCReplicateMirrorAsync:        "VOLUME_REPLICATE_MIRROR_ASYNC",
+	CapVolumeCReplicateMirrorSync:         "VOLUME_REPLICATE_MIRROR_SYNC",
+	CapVolumeCopyRangeBlockSize:           "VOLUME_COPY_RANGE_BLOCK_SIZE",
+	CapVolumeCopyRange:                    "VOLUME_COPY_RANGE",
+	CapVolumeCopyRangeClone:               "VOLUME_COPY_RANGE_CLONE",
+	CapVolumeCopyRangeCopy:                "VOLUME_COPY_RANGE_COPY",
+	CapVolumeDelete:                       "VOLUME_DELETE",
+	CapVolumeEnable:                       "VOLUME_ENABLE",
+	CapVolumeDisable:                      "VOLUME_DISABLE",
+	CapVolumeMask:                         "VOLUME_MASK",
+	CapVolumeUnmask:                       "VOLUME_UNMASK",
+	CapAccessGroups:                       "ACCESS_GROUPS",
+	CapAccessGroupCreateWwpn:              "ACCESS_GROUP_CREATE_WWPN",
+	CapAccessGroupDelete:                  "ACCESS_GROUP_DELETE",
+	CapAccessGroupInitiatorAddWwpn:        "ACCESS_GROUP_INITIATOR_ADD_WWPN",
+	CapAccessGroupInitiatorDel:            "ACCESS_GROUP_INITIATOR_DELETE",
+	CapVolumesMaskedToAg:                  "VOLUMES_ACCESSIBLE_BY_ACCESS_GROUP",
+	CapAgsGrantedToVol:                    "ACCESS_GROUPS_GRANTED_TO_VOLUME",
+	CapHasChildDep:                        "VOLUME_CHILD_DEPENDENCY",
+	CapChildDepRm:                         "VOLUME_CHILD_DEPENDENCY_RM",
+	CapAccessGroupCreateIscsiIqn:          "ACCESS_GROUP_CREATE_ISCSI_IQN",
+	CapAccessGroupInitAddIscsiIqn:         "ACCESS_GROUP_INITIATOR_ADD_ISCSI_IQN",
+	CapIscsiChapAuthSet:                   "VOLUME_ISCSI_CHAP_AUTHENTICATION",
+	CapVolRaidInfo:                        "VOLUME_RAID_INFO",
+	CapVolumeThin:                         "VOLUME_THIN",
+	CapBatteries:                          "BATTERIES",
+	CapVolCacheInfo:                       "VOLUME_CACHE_INFO",
+	CapVolPhyDiskCacheSet:                 "VOLUME_PHYSICAL_DISK_CACHE_UPDATE",
+	CapVolPhysicalDiskCacheSetSystemLevel: "VOLUME_PHYSICAL_DISK_CACHE_UPDATE_SYSTEM_LEVEL",
+	CapVolWriteCacheSetEnable:             "VOLUME_WRITE_CACHE_POLICY_UPDATE_WRITE_BACK",
+	CapVolWriteCacheSetAuto:               "VOLUME_WRITE_CACHE_POLICY_UPDATE_AUTO",
+	CapVolWriteCacheSetDisabled:           "VOLUME_WRITE_CACHE_POLICY_UPDATE_WRITE_THROUGH",
+	CapVolWriteCacheSetImpactRead:         "VOLUME_WRITE_CACHE_POLICY_UPDATE_IMPACT_READ",
+	CapVolWriteCacheSetWbImpactOther:      "VOLUME_WRITE_CACHE_POLICY_UPDATE_WB_IMPACT_OTHER",
+	CapVolReadCacheSet:                    "VOLUME_READ_CACHE_POLICY_UPDATE",
+	VolReadCacheSetImpactWrite:            "VOLUME_READ_CACHE_POLICY_UPDATE_IMPACT_WRITE",
+	CapFs:                                 "FS",
+	CapFsDelete:                           "FS_DELETE",
+	CapFsResize:                           "FS_RESIZE",
+	CapFsCreate:                           "FS_CREATE",
+	CapFsClone:                            "FS_CLONE",
+	CapFsFileClone:                        "FILE_CLONE",
+	CapFsSnapshots:                        "FS_SNAPSHOTS",
+	CapFsSnapshotCreate:                   "FS_SNAPSHOT_CREATE",
+	CapFsSnapshotDelete:                   "FS_SNAPSHOT_DELETE",
+	CapFsSnapshotRestore:                  "FS_SNAPSHOT_RESTORE",
+	CapFsSnapshotRestoreSpecificFiles:     "FS_SNAPSHOT_RESTORE_SPECIFIC_FILES",
+	CapFsHasChildDep:                      "FS_CHILD_DEPENDENCY",
+	CapFsChildDepRm:                       "FS_CHILD_DEPENDENCY_RM",
+	CapFsChildDepRmSpecificFiles:          "FS_CHILD_DEPENDENCY_RM_SPECIFIC_FILES",
+	CapNfsExportAuthTypeList:              "EXPORT_AUTH",
+	CapNfsExports:                         "EXPORTS",
+	CapFsExport:                           "EXPORT_FS",
+	CapFsUnexport:                         "EXPORT_REMOVE",
+	CapFsExportCustomPath:                 "EXPORT_CUSTOM_PATH",
+	CapSysReadCachePctSet:                 "SYS_READ_CACHE_PCT_UPDATE",
+	CapSysReadCachePctGet:                 "SYS_READ_CACHE_PCT_GET",
+	CapSysFwVersionGet:                    "SYS_FW_VERSION_GET",
+	CapSysModeGet:                         "SYS_MODE_GET",
+	CapDiskLocation:                       "DISK_LOCATION",
+	CapDiskRpm:                            "DISK_RPM",
+	CapDiskLinkType:                       "DISK_LINK_TYPE",
+	CapVolumeLed:                          "VOLUME_LED",
+	CapTargetPorts:                        "TARGET_PORTS",
+	CapDisks:                              "DISKS",
+	CapPoolMemberInfo:                     "POOL_MEMBER_INFO",
+	CapVolumeRaidCreate:                   "VOLUME_RAID_CREATE",
+	CapDiskVpd83Get:                       "DISK_VPD83_GET",
+}
+
+var capabilityValues = func() map[string]CapabilityType {
+	rc := make(map[string]CapabilityType, len(capabilityNames))
+	for cap, name := range capabilityNames {
+		rc[name] = cap
+	}
+	return rc
+}()
+
+// CapabilityTypes returns every capability known to this package, in
+// numeric order.
+func CapabilityTypes() []CapabilityType {
+	rc := make([]CapabilityType, 0, len(capabilityNames))
+	for cap := range capabilityNames {
+		rc = append(rc, cap)
+	}
+	sort.Slice(rc, func(i, j int) bool { return rc[i] < rc[j] })
+	return rc
+}
+
+// String returns the name libStorageMgmt uses for the capability, without
+// its LSM_CAP_ prefix, eg. VOLUME_CREATE, or its number for an unknown one.
+func (c CapabilityType) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(c), 10)
+}
+
+// MarshalText returns the name of the capability.
+func (c CapabilityType) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText accepts the name or the number of a capability.
+func (c *CapabilityType) UnmarshalText(text []byte) error {
+	if cap, ok := capabilityValues[string(text)]; ok {
+		*c = cap
+		return nil
+	}
+
+	n, err := strconv.ParseUint(string(text), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid capability %q", text)
+	}
+	*c = CapabilityType(n)
+	return nil
+}
+
+// Supported returns every capability supported, in numeric order, including
+// any unknown to this package.  Marshalled to JSON it is a list of names,
+// eg. ["VOLUMES","VOLUME_CREATE"].
+func (c *Capabilities) Supported() []CapabilityType {
+	var rc []CapabilityType
+	if c == nil {
+		return rc
+	}
+	for i := 0; i+2 <= len(c.Cap); i += 2 {
+		if c.Cap[i:i+2] == "01" {
+			rc = append(rc, CapabilityType(i/2))
+		}
+	}
+	return rc
+}
+
+// CapabilitiesDiff compares two sets of capabilities, eg. those of two
+// systems, returning those only a supports and those only b supports.  A nil
+// set supports nothing.
+func CapabilitiesDiff(a *Capabilities, b *Capabilities) (onlyA []CapabilityType, onlyB []CapabilityType) {
+	for _, cap := range a.Supported() {
+		if !b.IsSupported(cap) {
+			onlyA = append(onlyA, cap)
+		}
+	}
+	for _, cap := range b.Supported() {
+		if !a.IsSupported(cap) {
+			onlyB = append(onlyB, cap)
+		}
+	}
+	return onlyA, onlyB
+}
+
+// capabilityCount is the number of capabilities in the wire form, as in the
+// other libStorageMgmt implementations.
+const capabilityCount = 512
+
+// CapabilitiesBuilder assembles the capabilities a plugin returns from its
+// CapabilitiesCb.  The zero value supports nothing.
+type CapabilitiesBuilder struct {
+	cap []byte
+}
+
+// NewCapabilitiesBuilder returns a builder starting from base, eg. the result
+// of DeriveCapabilities, which is left unchanged.  A nil base supports
+// nothing.
+func NewCapabilitiesBuilder(base *Capabilities) *CapabilitiesBuilder {
+	var b CapabilitiesBuilder
+	if base != nil {
+		b.cap = []byte(base.Cap)
+	}
+	return &b
+}
+
+// Set marks the capabilities supported.
+func (b *CapabilitiesBuilder) Set(caps ...CapabilityType) *CapabilitiesBuilder {
+	for _, cap := range caps {
+		b.set(cap, '1')
+	}
+	return b
+}
+
+// Clear marks the capabilities unsupported.
+func (b *CapabilitiesBuilder) Clear(caps ...CapabilityType) *CapabilitiesBuilder {
+	for _, cap := range caps {
+		b.set(cap, '0')
+	}
+	return b
+}
+
+func (b *CapabilitiesBuilder) set(cap CapabilityType, value byte) {
+	var n = capabilityCount
+	if int(cap) >= n {
+		n = int(cap) + 1
+	}
+	for len(b.cap) < n*2 {
+		b.cap = append(b.cap, '0', '0')
+	}
+	b.cap[cap*2] = '0'
+	b.cap[cap*2+1] = value
+}
+
+// Capabilities returns the capabilities built so far in their wire form.
+func (b *CapabilitiesBuilder) Capabilities() *Capabilities {
+	var rc = &Capabilities{Class: "Capabilities", Cap: string(b.cap)}
+	if len(rc.Cap) < capabilityCount*2 {
+		rc.Cap += strings.Repeat("00", capabilityCount-len(rc.Cap)/2)
+	}
+	return rc
+}
+
+// impliedCapabilities lists the capabilities implied by plugin methods the
+// CapabilityGuard doesn't check.
+var impliedCapabilities = map[string][]CapabilityType{
+	"volumes":         {CapVolumes},
+	"disks":           {CapDisks},
+	"access_groups":   {CapAccessGroups},
+	"iscsi_chap_auth": {CapIscsiChapAuthSet},
+	"target_ports":    {CapTargetPorts},
+	"fs":              {CapFs},
+	"exports":         {CapNfsExports},
+	"export_fs":       {CapFsExport},
+	"export_remove":   {CapFsUnexport},
+	"export_auth":     {CapNfsExportAuthTypeList},
+	"batteries":       {CapBatteries},
+
+	// These have no basic capability, only one per variant, so all of them
+	// are implied.
+	"access_group_create":              {CapAccessGroupCreateWwpn, CapAccessGroupCreateIscsiIqn},
+	"access_group_initiator_add":       {CapAccessGroupInitiatorAddWwpn, CapAccessGroupInitAddIscsiIqn},
+	"volume_write_cache_policy_update": {CapVolWriteCacheSetEnable, CapVolWriteCacheSetAuto, CapVolWriteCacheSetDisabled},
+}
+
+// DeriveCapabilities returns the capabilities implied by the callbacks a
+// plugin implements, eg. SanOps.VolumeCreate implies CapVolumeCreate.  Only
+// the basic capability of each call is implied, those for variants of it,
+// eg. CapVolumeThin or CapVolumeCReplicateClone, and those about the
+// properties of what is returned, eg. CapDiskRpm, are left to the plugin to
+// set with NewCapabilitiesBuilder.  Calls with no basic capability, eg.
+// SanOps.AccessGroupCreate, imply those of every variant, so a plugin
+// supporting only some of them clears the others.
+func DeriveCapabilities(cb *PluginCallBacks) *Capabilities {
+	var b CapabilitiesBuilder
+	for method, h := range buildTable(cb) {
+		if h == nil {
+			continue
+		}
+		b.Set(impliedCapabilities[method]...)
+		b.Set(RequiredCapabilities(method, map[string]interface{}{})...)
+	}
+	return b.Capabilities()
+}
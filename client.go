@@ -3,24 +3,52 @@
 package libstoragemgmt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	errors "github.com/libstorage/libstoragemgmt-golang/errors"
 )
 
 // ClientConnection is the structure that encomposes the needed data for the plugin connection.
+// It is safe for concurrent use by multiple goroutines, requests are sent to
+// the plugin one at a time.
 type ClientConnection struct {
-	tp         transPort
+	tp         *transPort
+	reg        *registration
+	chain      *interceptors
 	PluginName string
-	timeout    uint32
+	ctx        context.Context
+	flags      uint64
+	polling    *JobPolling
+	jobs       *jobTracker
+}
+
+// registration holds what is needed to re-establish the connection with the
+// plugin.
+type registration struct {
+	mu        sync.Mutex
+	reconnect bool
+	uri       string
+	password  string
+	timeout   uint32
+	dial      func(ctx context.Context) (Transport, error)
+	retry     *RetryPolicy
 }
 
 // Client establishes a connection to a plugin as specified in the URI.
 func Client(uri string, password string, timeout uint32) (*ClientConnection, error) {
+	return ClientWithContext(context.Background(), uri, password, timeout)
+}
+
+// ClientWithContext establishes a connection to a plugin as specified in the URI,
+// giving up when ctx is done.  The context is only used for establishing the
+// connection, use WithContext to bound the calls made on it.
+func ClientWithContext(ctx context.Context, uri string, password string, timeout uint32) (*ClientConnection, error) {
 
 	p, parseError := url.Parse(uri)
 	if parseError != nil {
@@ -32,24 +60,181 @@ func Client(uri string, password string, timeout uint32) (*ClientConnection, err
 	pluginName := p.Scheme
 	pluginIpcPath := getPluginIpcPath(pluginName)
 
-	transport, transPortError := newTransport(pluginIpcPath, true)
+	transport, transPortError := newTransport(ctx, pluginIpcPath, true)
 	if transPortError != nil {
 		return nil, transPortError
 	}
 
-	args := map[string]interface{}{"password": password, "uri": uri, "timeout": timeout}
-	if libError := transport.invoke("plugin_register", args, nil); libError != nil {
+	reg := &registration{uri: uri, password: password, timeout: timeout,
+		dial: func(ctx context.Context) (Transport, error) {
+			return dial(ctx, getPluginIpcPath(pluginName), false)
+		}}
+	return register(ctx, transport, reg, pluginName)
+}
+
+// ClientWithTransport establishes a connection to a plugin at the other end of
+// the supplied transport, eg. a plugin started with PluginWithTransport.
+// Connections made this way can't be automatically reconnected.
+func ClientWithTransport(ctx context.Context, transport Transport, uri string, password string,
+	timeout uint32) (*ClientConnection, error) {
+
+	p, parseError := url.Parse(uri)
+	if parseError != nil {
+		return nil, &errors.LsmError{
+			Code:    errors.InvalidArgument,
+			Message: fmt.Sprintf("invalid uri: %s", parseError)}
+	}
+
+	reg := &registration{uri: uri, password: password, timeout: timeout}
+	return register(ctx, newTransPort(transport), reg, p.Scheme)
+}
+
+func register(ctx context.Context, transport *transPort, reg *registration, pluginName string) (*ClientConnection, error) {
+	transport.timeout = reg.timeout
+	if libError := reg.register(ctx, transport); libError != nil {
+		transport.close()
 		return nil, libError
 	}
 
-	return &ClientConnection{tp: *transport, PluginName: pluginName, timeout: timeout}, nil
+	return &ClientConnection{tp: transport, reg: reg, chain: &interceptors{}, PluginName: pluginName,
+		ctx: context.Background(), jobs: newJobTracker()}, nil
+}
+
+func (r *registration) register(ctx context.Context, t *transPort) error {
+	args := map[string]interface{}{"password": r.password, "uri": r.uri, "timeout": r.timeout}
+	return t.invoke(ctx, "plugin_register", args, nil)
+}
+
+// AutoReconnectSet enables or disables re-establishing the connection when
+// the plugin or lsmd goes away, eg. lsmd is restarted.  When enabled a call
+// which fails because the connection is broken causes the connection to be
+// re-opened and registered again with the original URI, password and
+// timeout, restoring any timeout changed with TimeOutSet.  Calls which only
+// retrieve information are then retried, calls which change state still
+// return the original error as we can't know if the plugin acted on them.
+// Outstanding jobs do not survive the plugin going away and are forgotten.
+func (c *ClientConnection) AutoReconnectSet(enable bool) {
+	c.reg.mu.Lock()
+	defer c.reg.mu.Unlock()
+	c.reg.reconnect = enable
+}
+
+// LoggerSet directs a record of every call made on the connection, shared by
+// all copies made with WithContext, to l.  Passwords are never logged.  nil
+// disables logging.
+func (c *ClientConnection) LoggerSet(l Logger) {
+	c.tp.loggerSet(l)
+}
+
+// MaxFrameSizeSet limits the size of a reply from the plugin, the default is
+// DefaultMaxFrameSize.  A larger reply fails with TransPortSerialization and
+// leaves the connection unusable.
+func (c *ClientConnection) MaxFrameSizeSet(size int) {
+	c.tp.maxFrameSizeSet(size)
+}
+
+// reconnect re-establishes a failed connection, returning true if the
+// connection is usable again.
+func (c *ClientConnection) reconnect(ctx context.Context) bool {
+	c.reg.mu.Lock()
+	defer c.reg.mu.Unlock()
+
+	if !c.reg.reconnect || c.reg.dial == nil {
+		return false
+	}
+
+	// Someone else already got here first
+	if c.tp.usable() {
+		return true
+	}
+
+	conn, dialError := c.reg.dial(ctx)
+	if dialError != nil {
+		return false
+	}
+
+	c.tp.reset(conn)
+	if regError := c.reg.register(ctx, c.tp); regError != nil {
+		c.tp.fail(regError)
+		return false
+	}
+	c.jobs.clear()
+
+	if current := c.tp.timeoutGet(); current != c.reg.timeout {
+		args := map[string]interface{}{"ms": current}
+		if tmoError := c.tp.invoke(ctx, "time_out_set", args, nil); tmoError != nil {
+			c.tp.fail(tmoError)
+			return false
+		}
+	}
+	return true
+}
+
+// WithContext returns a shallow copy of the connection which uses ctx for every
+// call made through it.  When ctx is done any outstanding I/O with the plugin
+// is aborted and an error with code errors.ContextExpired is returned.  The
+// copy shares the plugin connection with c, closing either closes both.
+func (c *ClientConnection) WithContext(ctx context.Context) *ClientConnection {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// WithFlags returns a shallow copy of the connection which passes flags to
+// the plugin with every call made through it, eg. vendor specific behaviour
+// such as forcing a delete.  Like WithContext the copy shares the plugin
+// connection with c.
+func (c *ClientConnection) WithFlags(flags uint64) *ClientConnection {
+	c2 := *c
+	c2.flags = flags
+	return &c2
+}
+
+// Flags returns the flags passed with calls on this connection.
+func (c *ClientConnection) Flags() uint64 {
+	return c.flags
+}
+
+// Context returns the context used for calls on this connection.
+func (c *ClientConnection) Context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+func (c *ClientConnection) invoke(cmd string, args map[string]interface{}, result interface{}) error {
+	args["flags"] = c.flags
+	return c.chain.wrap(c.call)(c.Context(), cmd, args, result)
+}
+
+// call is the end of the interceptor chain, sending the request to the plugin.
+func (c *ClientConnection) call(ctx context.Context, cmd string, args map[string]interface{}, result interface{}) error {
+	if policy := c.retryPolicy(); policy != nil {
+		return policy.do(ctx, cmd, func() error { return c.attempt(ctx, cmd, args, result) })
+	}
+	return c.attempt(ctx, cmd, args, result)
+}
+
+// attempt sends the request to the plugin once, or twice if the connection
+// had to be re-established.
+func (c *ClientConnection) attempt(ctx context.Context, cmd string, args map[string]interface{}, result interface{}) error {
+	err := c.tp.invoke(ctx, cmd, args, result)
+
+	if err != nil && cmd != "plugin_unregister" && !c.tp.usable() && c.reconnect(ctx) && isReadOnly(cmd) {
+		return c.tp.invoke(ctx, cmd, args, result)
+	}
+	return err
 }
 
 // PluginInfo information about the current plugin
 func (c *ClientConnection) PluginInfo() (*PluginInfo, error) {
 	args := make(map[string]interface{})
 	var info []string
-	if invokeError := c.tp.invoke("plugin_info", args, &info); invokeError != nil {
+	if invokeError := c.invoke("plugin_info", args, &info); invokeError != nil {
 		return nil, invokeError
 	}
 	return &PluginInfo{Description: info[0], Version: info[1], Name: c.PluginName}, nil
@@ -69,14 +254,14 @@ func AvailablePlugins() ([]PluginInfo, error) {
 	var pluginInfos []PluginInfo
 	for _, pluginPath := range getPlugins(udsPath) {
 
-		var trans, transError = newTransport(pluginPath, true)
+		var trans, transError = newTransport(context.Background(), pluginPath, true)
 		if transError != nil {
 			return nil, transError
 		}
 
 		args := make(map[string]interface{})
 		var info []string
-		invokeError := trans.invoke("plugin_info", args, &info)
+		invokeError := trans.invoke(context.Background(), "plugin_info", args, &info)
 
 		trans.close()
 
@@ -92,10 +277,13 @@ func AvailablePlugins() ([]PluginInfo, error) {
 	return pluginInfos, nil
 }
 
-// Close instructs the plugin to shutdown and exist.
+// Close instructs the plugin to shutdown and exist.  Jobs which haven't been
+// freed are first dealt with as set by JobCloseActionSet.
 func (c *ClientConnection) Close() error {
+	c.closeJobs()
+
 	args := make(map[string]interface{})
-	ourError := c.tp.invoke("plugin_unregister", args, nil)
+	ourError := c.invoke("plugin_unregister", args, nil)
 	c.tp.close()
 	return ourError
 }
@@ -104,85 +292,118 @@ func (c *ClientConnection) Close() error {
 func (c *ClientConnection) Systems() ([]System, error) {
 	args := make(map[string]interface{})
 	var systems []System
-	return systems, c.tp.invoke("systems", args, &systems)
+	return systems, c.invoke("systems", args, &systems)
 }
 
-// Volumes returns block device information
+// Volumes returns block device information, optionally only those matching
+// a search key and value, eg. "pool_id", "POOL_01".
 func (c *ClientConnection) Volumes(search ...string) ([]Volume, error) {
 	args := make(map[string]interface{})
+	if err := searchArgs("volumes", args, search); err != nil {
+		return make([]Volume, 0), err
+	}
+
 	var volumes []Volume
+	return volumes, c.invoke("volumes", args, &volumes)
+}
 
-	if !handleSearch(args, search) {
-		return make([]Volume, 0), &errors.LsmError{
-			Code: errors.InvalidArgument,
-			Message: fmt.Sprintf(
-				"volume supports 0 or 2 search parameters (key, value), provide %d", len(search)),
-			Data: ""}
+// VolumesMatching returns the volumes selected by filter.
+func (c *ClientConnection) VolumesMatching(filter VolumeFilter) ([]Volume, error) {
+	search := filter.search()
+	if err := checkFilter("volumes", search); err != nil {
+		return make([]Volume, 0), err
 	}
-
-	return volumes, c.tp.invoke("volumes", args, &volumes)
+	return c.Volumes(search...)
 }
 
 // Pools returns the units of storage that block devices and FS
-// can be created from.
+// can be created from, optionally only those matching a search key and value.
 func (c *ClientConnection) Pools(search ...string) ([]Pool, error) {
 	args := make(map[string]interface{})
-
-	if !handleSearch(args, search) {
-		return make([]Pool, 0), &errors.LsmError{
-			Code: errors.InvalidArgument,
-			Message: fmt.Sprintf(
-				"pool supports 0 or 2 search parameters (key, value), provide %d", len(search)),
-			Data: ""}
+	if err := searchArgs("pools", args, search); err != nil {
+		return make([]Pool, 0), err
 	}
 
 	var pools []Pool
-	return pools, c.tp.invoke("pools", args, &pools)
+	return pools, c.invoke("pools", args, &pools)
+}
+
+// PoolsMatching returns the pools selected by filter.
+func (c *ClientConnection) PoolsMatching(filter PoolFilter) ([]Pool, error) {
+	search := filter.search()
+	if err := checkFilter("pools", search); err != nil {
+		return make([]Pool, 0), err
+	}
+	return c.Pools(search...)
 }
 
-// Disks returns disks that are present.
-func (c *ClientConnection) Disks() ([]Disk, error) {
+// Disks returns disks that are present, optionally only those matching a
+// search key and value.
+func (c *ClientConnection) Disks(search ...string) ([]Disk, error) {
 	args := make(map[string]interface{})
+	if err := searchArgs("disks", args, search); err != nil {
+		return make([]Disk, 0), err
+	}
+
 	var disks []Disk
-	return disks, c.tp.invoke("disks", args, &disks)
+	return disks, c.invoke("disks", args, &disks)
+}
+
+// DisksMatching returns the disks selected by filter.
+func (c *ClientConnection) DisksMatching(filter DiskFilter) ([]Disk, error) {
+	search := filter.search()
+	if err := checkFilter("disks", search); err != nil {
+		return make([]Disk, 0), err
+	}
+	return c.Disks(search...)
 }
 
-// FileSystems returns pools that are present.
+// FileSystems returns pools that are present, optionally only those matching
+// a search key and value.
 func (c *ClientConnection) FileSystems(search ...string) ([]FileSystem, error) {
 	args := make(map[string]interface{})
+	if err := searchArgs("fs", args, search); err != nil {
+		return make([]FileSystem, 0), err
+	}
+
 	var fileSystems []FileSystem
+	return fileSystems, c.invoke("fs", args, &fileSystems)
+}
 
-	if !handleSearch(args, search) {
-		return make([]FileSystem, 0), &errors.LsmError{
-			Code: errors.InvalidArgument,
-			Message: fmt.Sprintf(
-				"fs supports 0 or 2 search parameters (key, value), provide %d", len(search)),
-			Data: ""}
+// FileSystemsMatching returns the file systems selected by filter.
+func (c *ClientConnection) FileSystemsMatching(filter FileSystemFilter) ([]FileSystem, error) {
+	search := filter.search()
+	if err := checkFilter("fs", search); err != nil {
+		return make([]FileSystem, 0), err
 	}
-
-	return fileSystems, c.tp.invoke("fs", args, &fileSystems)
+	return c.FileSystems(search...)
 }
 
-// NfsExports returns nfs exports  that are present.
+// NfsExports returns nfs exports  that are present, optionally only those
+// matching a search key and value.
 func (c *ClientConnection) NfsExports(search ...string) ([]NfsExport, error) {
 	args := make(map[string]interface{})
-
-	if !handleSearch(args, search) {
-		return make([]NfsExport, 0), &errors.LsmError{
-			Code: errors.InvalidArgument,
-			Message: fmt.Sprintf(
-				"NfsExports supports 0 or 2 search parameters (key, value), provide %d", len(search)),
-			Data: ""}
+	if err := searchArgs("exports", args, search); err != nil {
+		return make([]NfsExport, 0), err
 	}
 
 	var nfsExports []NfsExport
-	return nfsExports, c.tp.invoke("exports", args, &nfsExports)
+	return nfsExports, c.invoke("exports", args, &nfsExports)
+}
+
+// NfsExportsMatching returns the exports selected by filter.
+func (c *ClientConnection) NfsExportsMatching(filter NfsExportFilter) ([]NfsExport, error) {
+	search := filter.search()
+	if err := checkFilter("exports", search); err != nil {
+		return make([]NfsExport, 0), err
+	}
+	return c.NfsExports(search...)
 }
 
 // NfsExportAuthTypes returns list of support authentication types
 func (c *ClientConnection) NfsExportAuthTypes() ([]string, error) {
 	var authTypes []string
-	return authTypes, c.tp.invoke("export_auth", make(map[string]interface{}), &authTypes)
+	return authTypes, c.invoke("export_auth", make(map[string]interface{}), &authTypes)
 }
 
 // FsExport creates or modifies a NFS export.
@@ -227,7 +448,7 @@ func (c *ClientConnection) FsExport(fs *FileSystem, exportPath *string,
 		"options":     options,
 	}
 	var nfsExport NfsExport
-	if err := c.tp.invoke("export_fs", args, &nfsExport); err != nil {
+	if err := c.invoke("export_fs", args, &nfsExport); err != nil {
 		return nil, err
 	}
 	return &nfsExport, nil
@@ -236,35 +457,80 @@ func (c *ClientConnection) FsExport(fs *FileSystem, exportPath *string,
 // FsUnExport removes a file system export.
 func (c *ClientConnection) FsUnExport(export *NfsExport) error {
 	args := map[string]interface{}{"export": *export}
-	return c.tp.invoke("export_remove", args, nil)
+	return c.invoke("export_remove", args, nil)
 }
 
-// AccessGroups returns access groups  that are present.
-// TODO: Add search arguments
-func (c *ClientConnection) AccessGroups() ([]AccessGroup, error) {
+// AccessGroups returns access groups  that are present, optionally only those
+// matching a search key and value.
+func (c *ClientConnection) AccessGroups(search ...string) ([]AccessGroup, error) {
 	args := make(map[string]interface{})
+	if err := searchArgs("access_groups", args, search); err != nil {
+		return make([]AccessGroup, 0), err
+	}
+
 	var accessGroups []AccessGroup
-	return accessGroups, c.tp.invoke("access_groups", args, &accessGroups)
+	return accessGroups, c.invoke("access_groups", args, &accessGroups)
 }
 
-// TargetPorts returns target ports that are present.
-func (c *ClientConnection) TargetPorts() ([]TargetPort, error) {
+// AccessGroupsMatching returns the access groups selected by filter.
+func (c *ClientConnection) AccessGroupsMatching(filter AccessGroupFilter) ([]AccessGroup, error) {
+	search := filter.search()
+	if err := checkFilter("access_groups", search); err != nil {
+		return make([]AccessGroup, 0), err
+	}
+	return c.AccessGroups(search...)
+}
+
+// TargetPorts returns target ports that are present, optionally only those
+// matching a search key and value.
+func (c *ClientConnection) TargetPorts(search ...string) ([]TargetPort, error) {
 	args := make(map[string]interface{})
+	if err := searchArgs("target_ports", args, search); err != nil {
+		return make([]TargetPort, 0), err
+	}
+
 	var targetPorts []TargetPort
-	return targetPorts, c.tp.invoke("target_ports", args, &targetPorts)
+	return targetPorts, c.invoke("target_ports", args, &targetPorts)
+}
+
+// TargetPortsMatching returns the target ports selected by filter.
+func (c *ClientConnection) TargetPortsMatching(filter TargetPortFilter) ([]TargetPort, error) {
+	search := filter.search()
+	if err := checkFilter("target_ports", search); err != nil {
+		return make([]TargetPort, 0), err
+	}
+	return c.TargetPorts(search...)
 }
 
-// Batteries returns batteries that are present
-func (c *ClientConnection) Batteries() ([]Battery, error) {
+// Batteries returns batteries that are present, optionally only those
+// matching a search key and value.
+func (c *ClientConnection) Batteries(search ...string) ([]Battery, error) {
 	args := make(map[string]interface{})
+	if err := searchArgs("batteries", args, search); err != nil {
+		return make([]Battery, 0), err
+	}
+
 	var batteries []Battery
-	return batteries, c.tp.invoke("batteries", args, &batteries)
+	return batteries, c.invoke("batteries", args, &batteries)
+}
+
+// BatteriesMatching returns the batteries selected by filter.
+func (c *ClientConnection) BatteriesMatching(filter BatteryFilter) ([]Battery, error) {
+	search := filter.search()
+	if err := checkFilter("batteries", search); err != nil {
+		return make([]Battery, 0), err
+	}
+	return c.Batteries(search...)
 }
 
 // JobFree instructs the plugin to release resources for the job that was returned.
 func (c *ClientConnection) JobFree(jobID string) error {
 	args := map[string]interface{}{"job_id": jobID}
-	return c.tp.invoke("job_free", args, nil)
+	err := c.invoke("job_free", args, nil)
+	if code, _ := errors.Code(err); err == nil || code == errors.NotFoundJob {
+		c.jobs.remove(jobID)
+	}
+	return err
 }
 
 // JobStatus instructs the plugin to return the status of the specified job.  The returned values are
@@ -272,132 +538,105 @@ func (c *ClientConnection) JobFree(jobID string) error {
 // set the other two are meaningless.  If checking on the status of an operation that doesn't return a result
 // or you are not wanting the result, pass nil.
 func (c *ClientConnection) JobStatus(jobID string, returnedResult interface{}) (JobStatusType, uint8, error) {
+	status, percent, jobError, err := c.jobStatus(jobID, returnedResult)
+	if err != nil {
+		return JobStatusError, 0, err
+	}
+	return status, percent, jobError
+}
+
+// jobStatus is JobStatus keeping the error the job failed with, jobError,
+// apart from err, the error retrieving its status.
+func (c *ClientConnection) jobStatus(jobID string, returnedResult interface{}) (
+	status JobStatusType, percent uint8, jobError error, err error) {
+
 	args := map[string]interface{}{"job_id": jobID}
 
 	var result [3]json.RawMessage
-	if jobError := c.tp.invoke("job_status", args, &result); jobError != nil {
-		return JobStatusError, 0, jobError
+	if err = c.invoke("job_status", args, &result); err != nil {
+		return JobStatusError, 0, nil, err
 	}
 
-	var status JobStatusType
-	if statusMe := json.Unmarshal(result[0], &status); statusMe != nil {
-		return JobStatusError, 0, statusMe
+	if err = json.Unmarshal(result[0], &status); err != nil {
+		return JobStatusError, 0, nil, err
 	}
 
 	switch status {
 	case JobStatusInProgress:
-		var percent uint8
-		if percentError := json.Unmarshal(result[1], &percent); percentError != nil {
-			return JobStatusError, 0, percentError
+		if err = json.Unmarshal(result[1], &percent); err != nil {
+			return JobStatusError, 0, nil, err
 		}
-
-		return status, percent, nil
+		return status, percent, nil, nil
 	case JobStatusComplete:
 		// Some RPC calls with jobs do not return a value, thus the third item is
 		// "null"
 		if string(result[2]) != "null" && returnedResult != nil {
-			return status, 100, json.Unmarshal(result[2], returnedResult)
+			return status, 100, json.Unmarshal(result[2], returnedResult), nil
 		}
-		return status, 100, nil
+		return status, 100, nil, nil
 	case JobStatusError:
-		// Error
-		var error errors.LsmError
-		if checkErrorE := json.Unmarshal(result[2], &error); checkErrorE != nil {
-			return JobStatusError, 0, checkErrorE
+		var lsmError errors.LsmError
+		if err = json.Unmarshal(result[2], &lsmError); err != nil {
+			return JobStatusError, 0, nil, err
+		}
+		if lsmError.Code != errors.Ok {
+			return JobStatusError, 0, &lsmError, nil
 		}
 
 		return JobStatusError, 0, &errors.LsmError{
 			Code:    errors.PluginBug,
-			Message: "job_status returned error status with no error information"}
+			Message: "job_status returned error status with no error information"}, nil
 	default:
-		return JobStatusError, 0, &errors.LsmError{
+		return JobStatusError, 0, nil, &errors.LsmError{
 			Code:    errors.PluginBug,
 			Message: fmt.Sprintf("Invalid status type returned %v", status)}
 	}
 }
 
-func (c *ClientConnection) getJobOrResult(err error, returned [2]json.RawMessage, sync bool, result interface{}) (*string, error) {
-	if err != nil {
-		return nil, err
-	}
-
-	var job string
-	var um = json.Unmarshal(returned[0], &job)
-	if um == nil {
-		// We have a job, but want to wait for result, so do so.
-		if sync {
-			return nil, c.JobWait(job, result)
-		}
-
-		return &job, nil
-	}
-	// We have the result
-	return nil, json.Unmarshal(returned[1], result)
-}
-
-func (c *ClientConnection) getJobOrNone(err error, returned json.RawMessage, sync bool) (*string, error) {
-	if err != nil {
-		return nil, err
-	}
-
-	var job string
-	var um = json.Unmarshal(returned, &job)
-	if um == nil {
-		// We have a job, but want to wait for result, so do so.
-		if sync {
-			return nil, c.JobWait(job, nil)
-		}
-
-		return &job, nil
-	}
-	return nil, um
-}
-
 // JobWait waits for the job to finish and retrieves the end result in "returnedResult".
+// Waiting is abandoned if the context of the connection is done, aborting a
+// poll under way as described for WithContext.  The job is polled as set by
+// WithJobPolling.  The job is freed once it has finished,
+// successfully or not.
 func (c *ClientConnection) JobWait(jobID string, returnedResult interface{}) error {
-
-	for {
-		var status, _, err = c.JobStatus(jobID, returnedResult)
-		if err != nil {
-			return err
-		}
-
-		if status == JobStatusInProgress {
-			time.Sleep(time.Millisecond * 250)
-			continue
-		} else if status == JobStatusComplete {
-			if freeError := c.JobFree(jobID); freeError != nil {
-				return &errors.LsmError{
-					Code: errors.PluginBug,
-					Message: fmt.Sprintf(
-						"We successfully waited for job %s, but got an error freeing it: %s", jobID, freeError)}
-			}
-			break
-		}
-	}
-	return nil
+	j := &job{c: c, id: jobID, result: returnedResult, status: JobStatusInProgress}
+	return j.wait(c.Context())
 }
 
 // Capabilities retrieve capabilities
 func (c *ClientConnection) Capabilities(system *System) (*Capabilities, error) {
 	args := map[string]interface{}{"system": *system}
 	var cap Capabilities
-	return &cap, c.tp.invoke("capabilities", args, &cap)
+	return &cap, c.invoke("capabilities", args, &cap)
 }
 
 // TimeOutSet sets the connection timeout with the storage device.
 func (c *ClientConnection) TimeOutSet(milliSeconds uint32) error {
 	args := map[string]interface{}{"ms": milliSeconds}
-	var err = c.tp.invoke("time_out_set", args, nil)
+	var err = c.invoke("time_out_set", args, nil)
 	if err == nil {
-		c.timeout = milliSeconds
+		c.tp.timeoutSet(milliSeconds)
 	}
 	return err
 }
 
 // TimeOutGet sets the connection timeout with the storage device.
 func (c *ClientConnection) TimeOutGet() uint32 {
-	return c.timeout
+	return c.tp.timeoutGet()
+}
+
+// TimeOutGraceSet sets how much longer than the connection timeout we wait for
+// the plugin to reply before the call fails with errors.TimeOut.  A call that
+// times out leaves the connection unusable, so the grace period allows the
+// plugin to report its own timeout first.  Defaults to DefaultTimeOutGrace.
+func (c *ClientConnection) TimeOutGraceSet(grace time.Duration) {
+	c.tp.graceSet(grace)
+}
+
+// TimeOutGraceGet returns how much longer than the connection timeout we wait
+// for the plugin to reply.
+func (c *ClientConnection) TimeOutGraceGet() time.Duration {
+	return c.tp.graceGet()
 }
 
 // SysReadCachePctSet changes the read cache percentage for the specified system.
@@ -411,7 +650,7 @@ func (c *ClientConnection) SysReadCachePctSet(system *System, readPercent uint32
 	}
 
 	args := map[string]interface{}{"system": *system, "read_pct": readPercent}
-	return c.tp.invoke("system_read_cache_pct_update", args, nil)
+	return c.invoke("system_read_cache_pct_update", args, nil)
 }
 
 // IscsiChapAuthSet iSCSI CHAP authentication.
@@ -426,7 +665,7 @@ func (c *ClientConnection) IscsiChapAuthSet(initID string, inUser *string, inPas
 		"out_password": outPassword,
 	}
 
-	return c.tp.invoke("iscsi_chap_auth", args, nil)
+	return c.invoke("iscsi_chap_auth", args, nil)
 }
 
 // VolumeCreate creates a block device, returns job id, error.
@@ -437,39 +676,65 @@ func (c *ClientConnection) VolumeCreate(
 	size uint64,
 	provisioning VolumeProvisionType,
 	sync bool) (*Volume, *string, error) {
+	job, err := c.VolumeCreateAsync(pool, volumeName, size, provisioning)
+	return volumeOrJob(job, err, sync)
+}
+
+// VolumeCreateAsync creates a block device, returning a handle on the job
+// doing so.
+func (c *ClientConnection) VolumeCreateAsync(
+	pool *Pool,
+	volumeName string,
+	size uint64,
+	provisioning VolumeProvisionType) (*VolumeJob, error) {
 	args := map[string]interface{}{
 		"pool":         *pool,
 		"volume_name":  volumeName,
 		"size_bytes":   size,
 		"provisioning": provisioning,
 	}
-
-	var returnedVolume Volume
-	var result [2]json.RawMessage
-	jobID, err := c.getJobOrResult(c.tp.invoke("volume_create", args, &result), result, sync, &returnedVolume)
-	return ensureExclusiveVol(&returnedVolume, jobID, err)
+	return c.volumeJob("volume_create", args)
 }
 
 // VolumeDelete deletes a block device.
 func (c *ClientConnection) VolumeDelete(vol *Volume, sync bool) (*string, error) {
+	job, err := c.VolumeDeleteAsync(vol)
+	return jobOrWait(job, err, sync)
+}
+
+// VolumeDeleteAsync deletes a block device, returning a handle on the job
+// doing so.
+func (c *ClientConnection) VolumeDeleteAsync(vol *Volume) (*Job, error) {
 	args := map[string]interface{}{"volume": *vol}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("volume_delete", args, &result), result, sync)
+	return c.noResultJob("volume_delete", args)
 }
 
 // VolumeResize resizes an existing volume, data loss may occur depending on storage implementation.
 func (c *ClientConnection) VolumeResize(vol *Volume, newSizeBytes uint64, sync bool) (*Volume, *string, error) {
+	job, err := c.VolumeResizeAsync(vol, newSizeBytes)
+	return volumeOrJob(job, err, sync)
+}
+
+// VolumeResizeAsync resizes an existing volume, returning a handle on the job
+// doing so.
+func (c *ClientConnection) VolumeResizeAsync(vol *Volume, newSizeBytes uint64) (*VolumeJob, error) {
 	args := map[string]interface{}{"volume": *vol, "new_size_bytes": newSizeBytes}
-	var returnedVolume Volume
-	var result [2]json.RawMessage
-	job, err := c.getJobOrResult(c.tp.invoke("volume_resize", args, &result), result, sync, &returnedVolume)
-	return ensureExclusiveVol(&returnedVolume, job, err)
+	return c.volumeJob("volume_resize", args)
 }
 
 // VolumeReplicate makes a replicated image of existing Volume
 func (c *ClientConnection) VolumeReplicate(
 	optionalPool *Pool, repType VolumeReplicateType, sourceVolume *Volume, name string,
 	sync bool) (*Volume, *string, error) {
+	job, err := c.VolumeReplicateAsync(optionalPool, repType, sourceVolume, name)
+	return volumeOrJob(job, err, sync)
+}
+
+// VolumeReplicateAsync makes a replicated image of existing Volume, returning
+// a handle on the job doing so.
+func (c *ClientConnection) VolumeReplicateAsync(
+	optionalPool *Pool, repType VolumeReplicateType, sourceVolume *Volume,
+	name string) (*VolumeJob, error) {
 
 	args := map[string]interface{}{
 		"volume_src": *sourceVolume,
@@ -481,24 +746,29 @@ func (c *ClientConnection) VolumeReplicate(
 	} else {
 		args["pool"] = nil
 	}
-
-	var returnedVolume Volume
-	var result [2]json.RawMessage
-	job, err := c.getJobOrResult(c.tp.invoke("volume_replicate", args, &result), result, sync, &returnedVolume)
-	return ensureExclusiveVol(&returnedVolume, job, err)
+	return c.volumeJob("volume_replicate", args)
 }
 
 // VolumeRepRangeBlkSize block size for replicating a range of blocks
 func (c *ClientConnection) VolumeRepRangeBlkSize(system *System) (uint32, error) {
 	args := map[string]interface{}{"system": *system}
 	var blkSize uint32
-	return blkSize, c.tp.invoke("volume_replicate_range_block_size", args, &blkSize)
+	return blkSize, c.invoke("volume_replicate_range_block_size", args, &blkSize)
 }
 
 // VolumeReplicateRange replicates a range of blocks on the same or different Volume
 func (c *ClientConnection) VolumeReplicateRange(
 	repType VolumeReplicateType, srcVol *Volume, dstVol *Volume,
 	ranges []BlockRange, sync bool) (*string, error) {
+	job, err := c.VolumeReplicateRangeAsync(repType, srcVol, dstVol, ranges)
+	return jobOrWait(job, err, sync)
+}
+
+// VolumeReplicateRangeAsync replicates a range of blocks on the same or
+// different Volume, returning a handle on the job doing so.
+func (c *ClientConnection) VolumeReplicateRangeAsync(
+	repType VolumeReplicateType, srcVol *Volume, dstVol *Volume,
+	ranges []BlockRange) (*Job, error) {
 
 	args := map[string]interface{}{
 		"rep_type":    repType,
@@ -506,60 +776,65 @@ func (c *ClientConnection) VolumeReplicateRange(
 		"volume_src":  *srcVol,
 		"volume_dest": *dstVol,
 	}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("volume_replicate_range", args, &result), result, sync)
+	return c.noResultJob("volume_replicate_range", args)
 }
 
 // VolumeEnable sets a volume to online.
 func (c *ClientConnection) VolumeEnable(vol *Volume) error {
 	args := map[string]interface{}{"volume": *vol}
-	return c.tp.invoke("volume_enable", args, nil)
+	return c.invoke("volume_enable", args, nil)
 }
 
 // VolumeDisable sets a volume to offline.
 func (c *ClientConnection) VolumeDisable(vol *Volume) error {
 	args := map[string]interface{}{"volume": *vol}
-	return c.tp.invoke("volume_disable", args, nil)
+	return c.invoke("volume_disable", args, nil)
 }
 
 // VolumeMask grants access to a volume for the specified access group.
 func (c *ClientConnection) VolumeMask(vol *Volume, ag *AccessGroup) error {
 	args := map[string]interface{}{"volume": *vol, "access_group": *ag}
-	return c.tp.invoke("volume_mask", args, nil)
+	return c.invoke("volume_mask", args, nil)
 }
 
 // VolumeUnMask removes access to a volume for the specified access group.
 func (c *ClientConnection) VolumeUnMask(vol *Volume, ag *AccessGroup) error {
 	args := map[string]interface{}{"volume": *vol, "access_group": *ag}
-	return c.tp.invoke("volume_unmask", args, nil)
+	return c.invoke("volume_unmask", args, nil)
 }
 
 // VolsMaskedToAg returns the volumes accessible to access group
 func (c *ClientConnection) VolsMaskedToAg(ag *AccessGroup) ([]Volume, error) {
 	args := map[string]interface{}{"access_group": *ag}
 	var volumes []Volume
-	return volumes, c.tp.invoke("volumes_accessible_by_access_group", args, &volumes)
+	return volumes, c.invoke("volumes_accessible_by_access_group", args, &volumes)
 }
 
 // AgsGrantedToVol returns access group(s) which have access to specified volume
 func (c *ClientConnection) AgsGrantedToVol(vol *Volume) ([]AccessGroup, error) {
 	args := map[string]interface{}{"volume": *vol}
 	var accessGroups []AccessGroup
-	return accessGroups, c.tp.invoke("access_groups_granted_to_volume", args, &accessGroups)
+	return accessGroups, c.invoke("access_groups_granted_to_volume", args, &accessGroups)
 }
 
 // VolHasChildDep returns true|false if volume has child dependency
 func (c *ClientConnection) VolHasChildDep(vol *Volume) (bool, error) {
 	args := map[string]interface{}{"volume": *vol}
 	var deps bool
-	return deps, c.tp.invoke("volume_child_dependency", args, &deps)
+	return deps, c.invoke("volume_child_dependency", args, &deps)
 }
 
 // VolChildDepRm removes any child dependencies
 func (c *ClientConnection) VolChildDepRm(vol *Volume, sync bool) (*string, error) {
+	job, err := c.VolChildDepRmAsync(vol)
+	return jobOrWait(job, err, sync)
+}
+
+// VolChildDepRmAsync removes any child dependencies, returning a handle on the
+// job doing so.
+func (c *ClientConnection) VolChildDepRmAsync(vol *Volume) (*Job, error) {
 	args := map[string]interface{}{"volume": *vol}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("volume_child_dependency_rm", args, &result), result, sync)
+	return c.noResultJob("volume_child_dependency_rm", args)
 }
 
 // FsCreate creates a file system, returns job id, error.
@@ -569,32 +844,44 @@ func (c *ClientConnection) FsCreate(
 	name string,
 	size uint64,
 	sync bool) (*FileSystem, *string, error) {
+	job, err := c.FsCreateAsync(pool, name, size)
+	return fsOrJob(job, err, sync)
+}
+
+// FsCreateAsync creates a file system, returning a handle on the job doing so.
+func (c *ClientConnection) FsCreateAsync(pool *Pool, name string, size uint64) (*FileSystemJob, error) {
 	args := map[string]interface{}{
 		"pool":       *pool,
 		"name":       name,
 		"size_bytes": size,
 	}
-	var returnedFs FileSystem
-	var result [2]json.RawMessage
-	job, err := c.getJobOrResult(c.tp.invoke("fs_create", args, &result), result, sync, &returnedFs)
-	return ensureExclusiveFs(&returnedFs, job, err)
+	return c.fsJob("fs_create", args)
 }
 
 // FsResize resizes an existing file system
 func (c *ClientConnection) FsResize(
 	fs *FileSystem, newSizeBytes uint64, sync bool) (*FileSystem, *string, error) {
+	job, err := c.FsResizeAsync(fs, newSizeBytes)
+	return fsOrJob(job, err, sync)
+}
+
+// FsResizeAsync resizes an existing file system, returning a handle on the job
+// doing so.
+func (c *ClientConnection) FsResizeAsync(fs *FileSystem, newSizeBytes uint64) (*FileSystemJob, error) {
 	args := map[string]interface{}{"fs": *fs, "new_size_bytes": newSizeBytes}
-	var returnedFs FileSystem
-	var result [2]json.RawMessage
-	job, err := c.getJobOrResult(c.tp.invoke("fs_resize", args, &result), result, sync, &returnedFs)
-	return ensureExclusiveFs(&returnedFs, job, err)
+	return c.fsJob("fs_resize", args)
 }
 
 // FsDelete deletes a file system.
 func (c *ClientConnection) FsDelete(fs *FileSystem, sync bool) (*string, error) {
+	job, err := c.FsDeleteAsync(fs)
+	return jobOrWait(job, err, sync)
+}
+
+// FsDeleteAsync deletes a file system, returning a handle on the job doing so.
+func (c *ClientConnection) FsDeleteAsync(fs *FileSystem) (*Job, error) {
 	args := map[string]interface{}{"fs": *fs}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("fs_delete", args, &result), result, sync)
+	return c.noResultJob("fs_delete", args)
 }
 
 // FsClone makes a clone of an existing file system
@@ -603,14 +890,20 @@ func (c *ClientConnection) FsClone(
 	destName string,
 	optionalSnapShot *FileSystemSnapShot,
 	sync bool) (*FileSystem, *string, error) {
+	job, err := c.FsCloneAsync(srcFs, destName, optionalSnapShot)
+	return fsOrJob(job, err, sync)
+}
+
+// FsCloneAsync makes a clone of an existing file system, returning a handle
+// on the job doing so.
+func (c *ClientConnection) FsCloneAsync(
+	srcFs *FileSystem,
+	destName string,
+	optionalSnapShot *FileSystemSnapShot) (*FileSystemJob, error) {
 	args := map[string]interface{}{"src_fs": *srcFs, "dest_fs_name": destName}
 
 	handleSnapshotOptArg(args, optionalSnapShot)
-
-	var returnedFs FileSystem
-	var result [2]json.RawMessage
-	job, err := c.getJobOrResult(c.tp.invoke("fs_clone", args, &result), result, sync, &returnedFs)
-	return ensureExclusiveFs(&returnedFs, job, err)
+	return c.fsJob("fs_clone", args)
 }
 
 // FsFileClone makes a clone of an existing file system
@@ -621,6 +914,18 @@ func (c *ClientConnection) FsFileClone(
 	optionalSnapShot *FileSystemSnapShot,
 	sync bool,
 ) (*string, error) {
+	job, err := c.FsFileCloneAsync(fs, srcFileName, dstFileName, optionalSnapShot)
+	return jobOrWait(job, err, sync)
+}
+
+// FsFileCloneAsync makes a clone of a file on a file system, returning a
+// handle on the job doing so.
+func (c *ClientConnection) FsFileCloneAsync(
+	fs *FileSystem,
+	srcFileName string,
+	dstFileName string,
+	optionalSnapShot *FileSystemSnapShot,
+) (*Job, error) {
 	args := map[string]interface{}{
 		"fs":             *fs,
 		"src_file_name":  srcFileName,
@@ -628,26 +933,34 @@ func (c *ClientConnection) FsFileClone(
 	}
 
 	handleSnapshotOptArg(args, optionalSnapShot)
-
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("fs_file_clone", args, &result), result, sync)
+	return c.noResultJob("fs_file_clone", args)
 }
 
 // FsSnapShotCreate creates a file system snapshot for the supplied snapshot
 // If job id and error are nil, then returnedFs has newly created filesystem.
 func (c *ClientConnection) FsSnapShotCreate(fs *FileSystem, name string, sync bool) (*FileSystemSnapShot, *string, error) {
+	job, err := c.FsSnapShotCreateAsync(fs, name)
+	return snapShotOrJob(job, err, sync)
+}
+
+// FsSnapShotCreateAsync creates a file system snapshot, returning a handle on
+// the job doing so.
+func (c *ClientConnection) FsSnapShotCreateAsync(fs *FileSystem, name string) (*FileSystemSnapShotJob, error) {
 	args := map[string]interface{}{"fs": *fs, "snapshot_name": name}
-	var returnedSnapshot FileSystemSnapShot
-	var result [2]json.RawMessage
-	job, err := c.getJobOrResult(c.tp.invoke("fs_snapshot_create", args, &result), result, sync, &returnedSnapshot)
-	return ensureExclusiveSs(&returnedSnapshot, job, err)
+	return c.snapShotJob("fs_snapshot_create", args)
 }
 
 // FsSnapShotDelete deletes a file system snapshot.
 func (c *ClientConnection) FsSnapShotDelete(fs *FileSystem, snapShot *FileSystemSnapShot, sync bool) (*string, error) {
+	job, err := c.FsSnapShotDeleteAsync(fs, snapShot)
+	return jobOrWait(job, err, sync)
+}
+
+// FsSnapShotDeleteAsync deletes a file system snapshot, returning a handle on
+// the job doing so.
+func (c *ClientConnection) FsSnapShotDeleteAsync(fs *FileSystem, snapShot *FileSystemSnapShot) (*Job, error) {
 	args := map[string]interface{}{"fs": *fs, "snapshot": *snapShot}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("fs_snapshot_delete", args, &result), result, sync)
+	return c.noResultJob("fs_snapshot_delete", args)
 }
 
 // FsSnapShots returns list of file system snapsthos for specified file system.
@@ -655,13 +968,22 @@ func (c *ClientConnection) FsSnapShotDelete(fs *FileSystem, snapShot *FileSystem
 func (c *ClientConnection) FsSnapShots(fs *FileSystem) ([]FileSystemSnapShot, error) {
 	args := map[string]interface{}{"fs": *fs}
 	var snapShots []FileSystemSnapShot
-	return snapShots, c.tp.invoke("fs_snapshots", args, &snapShots)
+	return snapShots, c.invoke("fs_snapshots", args, &snapShots)
 }
 
 // FsSnapShotRestore restores all the files for a file systems or specific files.
 func (c *ClientConnection) FsSnapShotRestore(
 	fs *FileSystem, snapShot *FileSystemSnapShot, allFiles bool,
 	files []string, restoreFiles []string, sync bool) (*string, error) {
+	job, err := c.FsSnapShotRestoreAsync(fs, snapShot, allFiles, files, restoreFiles)
+	return jobOrWait(job, err, sync)
+}
+
+// FsSnapShotRestoreAsync restores all the files for a file systems or specific
+// files, returning a handle on the job doing so.
+func (c *ClientConnection) FsSnapShotRestoreAsync(
+	fs *FileSystem, snapShot *FileSystemSnapShot, allFiles bool,
+	files []string, restoreFiles []string) (*Job, error) {
 
 	if !allFiles {
 		if len(files) == 0 {
@@ -684,23 +1006,28 @@ func (c *ClientConnection) FsSnapShotRestore(
 		"restore_files": restoreFiles,
 		"all_files":     allFiles,
 	}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("fs_snapshot_restore", args, &result), result, sync)
+	return c.noResultJob("fs_snapshot_restore", args)
 }
 
 // FsHasChildDep checks whether file system has a child dependency.
 func (c *ClientConnection) FsHasChildDep(fs *FileSystem, files []string) (bool, error) {
 	args := map[string]interface{}{"fs": *fs, "files": files}
 	var result bool
-	return result, c.tp.invoke("fs_child_dependency", args, &result)
+	return result, c.invoke("fs_child_dependency", args, &result)
 }
 
 // FsChildDepRm remove dependencies for specified file system.
 func (c *ClientConnection) FsChildDepRm(
 	fs *FileSystem, files []string, sync bool) (*string, error) {
+	job, err := c.FsChildDepRmAsync(fs, files)
+	return jobOrWait(job, err, sync)
+}
+
+// FsChildDepRmAsync remove dependencies for specified file system, returning
+// a handle on the job doing so.
+func (c *ClientConnection) FsChildDepRmAsync(fs *FileSystem, files []string) (*Job, error) {
 	args := map[string]interface{}{"fs": *fs, "files": files}
-	var result json.RawMessage
-	return c.getJobOrNone(c.tp.invoke("fs_child_dependency_rm", args, &result), result, sync)
+	return c.noResultJob("fs_child_dependency_rm", args)
 }
 
 // AccessGroupCreate creates an access group.
@@ -718,7 +1045,7 @@ func (c *ClientConnection) AccessGroupCreate(name string, initID string,
 		"system":    *system,
 	}
 	var accessGroup AccessGroup
-	if err := c.tp.invoke("access_group_create", args, &accessGroup); err != nil {
+	if err := c.invoke("access_group_create", args, &accessGroup); err != nil {
 		return nil, err
 	}
 	return &accessGroup, nil
@@ -727,7 +1054,7 @@ func (c *ClientConnection) AccessGroupCreate(name string, initID string,
 // AccessGroupDelete deletes an access group.
 func (c *ClientConnection) AccessGroupDelete(ag *AccessGroup) error {
 	args := map[string]interface{}{"access_group": *ag}
-	return c.tp.invoke("access_group_delete", args, nil)
+	return c.invoke("access_group_delete", args, nil)
 }
 
 func initSetup(initID string,
@@ -746,7 +1073,7 @@ func (c *ClientConnection) AccessGroupInitAdd(ag *AccessGroup,
 	}
 
 	var accessGroup AccessGroup
-	if err := c.tp.invoke("access_group_initiator_add", args, &accessGroup); err != nil {
+	if err := c.invoke("access_group_initiator_add", args, &accessGroup); err != nil {
 		return nil, err
 	}
 	return &accessGroup, nil
@@ -760,7 +1087,7 @@ func (c *ClientConnection) AccessGroupInitDelete(ag *AccessGroup,
 		return nil, setupErr
 	}
 	var accessGroup AccessGroup
-	if err := c.tp.invoke("access_group_initiator_delete", args, &accessGroup); err != nil {
+	if err := c.invoke("access_group_initiator_delete", args, &accessGroup); err != nil {
 		return nil, err
 	}
 	return &accessGroup, nil
@@ -771,7 +1098,7 @@ func (c *ClientConnection) VolRaidInfo(vol *Volume) (*VolumeRaidInfo, error) {
 	args := map[string]interface{}{"volume": *vol}
 
 	var ret [5]int32
-	if err := c.tp.invoke("volume_raid_info", args, &ret); err != nil {
+	if err := c.invoke("volume_raid_info", args, &ret); err != nil {
 		return nil, err
 	}
 	var info VolumeRaidInfo
@@ -788,7 +1115,7 @@ func (c *ClientConnection) PoolMemberInfo(pool *Pool) (*PoolMemberInfo, error) {
 	args := map[string]interface{}{"pool": *pool}
 
 	var ret [3]json.RawMessage
-	if err := c.tp.invoke("pool_member_info", args, &ret); err != nil {
+	if err := c.invoke("pool_member_info", args, &ret); err != nil {
 		return nil, err
 	}
 
@@ -821,7 +1148,7 @@ func (c *ClientConnection) PoolMemberInfo(pool *Pool) (*PoolMemberInfo, error) {
 func (c *ClientConnection) VolRaidCreateCapGet(system *System) (*SupportedRaidCapability, error) {
 	args := map[string]interface{}{"system": *system}
 	var ret []json.RawMessage
-	if err := c.tp.invoke("volume_raid_create_cap_get", args, &ret); err != nil {
+	if err := c.invoke("volume_raid_create_cap_get", args, &ret); err != nil {
 		return nil, err
 	}
 
@@ -886,7 +1213,7 @@ func (c *ClientConnection) VolRaidCreate(name string,
 		"strip_size": stripSize, //stripe
 	}
 	var returnedVolume Volume
-	if err := c.tp.invoke("volume_raid_create", args, &returnedVolume); err != nil {
+	if err := c.invoke("volume_raid_create", args, &returnedVolume); err != nil {
 		return nil, err
 	}
 	return &returnedVolume, nil
@@ -894,7 +1221,7 @@ func (c *ClientConnection) VolRaidCreate(name string,
 
 func (c *ClientConnection) identLED(volume *Volume, method string) error {
 	args := map[string]interface{}{"volume": *volume}
-	return c.tp.invoke(method, args, nil)
+	return c.invoke(method, args, nil)
 }
 
 // VolIdentLedOn turn on the identification LED for the specified volume.
@@ -912,7 +1239,7 @@ func (c *ClientConnection) VolCacheInfo(volume *Volume) (*VolumeCacheInfo, error
 	args := map[string]interface{}{"volume": *volume}
 
 	var ret [5]uint32
-	if err := c.tp.invoke("volume_cache_info", args, &ret); err != nil {
+	if err := c.invoke("volume_cache_info", args, &ret); err != nil {
 		return nil, err
 	}
 
@@ -931,7 +1258,7 @@ func (c *ClientConnection) VolPhyDiskCacheSet(volume *Volume, pdc PhysicalDiskCa
 		"volume": *volume,
 		"pdc":    pdc,
 	}
-	return c.tp.invoke("volume_physical_disk_cache_update", args, nil)
+	return c.invoke("volume_physical_disk_cache_update", args, nil)
 }
 
 // VolWriteCacheSet sets volume write cache policy
@@ -940,7 +1267,7 @@ func (c *ClientConnection) VolWriteCacheSet(volume *Volume, wcp WriteCachePolicy
 		"volume": *volume,
 		"wcp":    wcp,
 	}
-	return c.tp.invoke("volume_write_cache_policy_update", args, nil)
+	return c.invoke("volume_write_cache_policy_update", args, nil)
 }
 
 // VolReadCacheSet sets volume read cache policy
@@ -949,5 +1276,5 @@ func (c *ClientConnection) VolReadCacheSet(volume *Volume, rcp ReadCachePolicy)
 		"volume": *volume,
 		"rcp":    rcp,
 	}
-	return c.tp.invoke("volume_read_cache_policy_update", args, nil)
+	return c.invoke("volume_read_cache_policy_update", args, nil)
 }
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// ClientPool hands out connections to a single plugin URI so that calls can
+// be made in parallel.  Connections are opened as needed up to the size of
+// the pool and reused once they are returned.  Connections which have failed
+// are discarded and replaced on demand.
+type ClientPool struct {
+	uri      string
+	password string
+	timeout  uint32
+	slots    chan struct{}
+
+	mu     sync.Mutex
+	idle   []*ClientConnection
+	closed bool
+}
+
+// NewClientPool creates a pool of up to size connections to the plugin
+// specified in the URI, no connections are made until they are needed.
+func NewClientPool(uri string, password string, timeout uint32, size int) (*ClientPool, error) {
+	if size < 1 {
+		return nil, &errors.LsmError{
+			Code:    errors.InvalidArgument,
+			Message: fmt.Sprintf("invalid pool size: %d", size)}
+	}
+
+	if _, parseError := url.Parse(uri); parseError != nil {
+		return nil, &errors.LsmError{
+			Code:    errors.InvalidArgument,
+			Message: fmt.Sprintf("invalid uri: %s", parseError)}
+	}
+
+	return &ClientPool{
+		uri:      uri,
+		password: password,
+		timeout:  timeout,
+		slots:    make(chan struct{}, size)}, nil
+}
+
+func poolClosedError() error {
+	return &errors.LsmError{
+		Code:    errors.InvalidArgument,
+		Message: "client pool is closed"}
+}
+
+// Get returns a connection for exclusive use by the caller, waiting for one
+// to be returned if all of them are in use.  An idle connection is checked
+// with a call to the plugin under ctx first, and replaced if it has failed.
+// The connection must be handed back with Put.
+func (p *ClientPool) Get(ctx context.Context) (*ClientConnection, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, contextError("pool get", ctx.Err())
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, poolClosedError()
+	}
+
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if alive(ctx, c) {
+			return c, nil
+		}
+		c.tp.close()
+		p.mu.Lock()
+	}
+	p.mu.Unlock()
+
+	c, err := ClientWithContext(ctx, p.uri, p.password, p.timeout)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// alive checks an idle connection still works before it is handed out, the
+// plugin or lsmd may have closed it in the meantime.  Errors reported by the
+// plugin, eg. NoSupport, still show the connection is alive.
+func alive(ctx context.Context, c *ClientConnection) bool {
+	if !c.tp.usable() {
+		return false
+	}
+	var ms uint32
+	c.tp.invoke(ctx, "time_out_get", map[string]interface{}{"flags": 0}, &ms)
+	return c.tp.usable()
+}
+
+// Put returns a connection retrieved with Get to the pool.  Connections which
+// are no longer usable are closed and will be replaced when needed.
+func (p *ClientPool) Put(c *ClientConnection) {
+	p.mu.Lock()
+	if !p.closed && c.tp.usable() {
+		p.idle = append(p.idle, c.WithContext(context.Background()))
+		p.mu.Unlock()
+	} else {
+		p.mu.Unlock()
+		c.WithContext(context.Background()).Close()
+	}
+	<-p.slots
+}
+
+// Do runs f with a connection from the pool, bounded by ctx.
+func (p *ClientPool) Do(ctx context.Context, f func(c *ClientConnection) error) error {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Put(c)
+	return f(c.WithContext(ctx))
+}
+
+// Close closes the idle connections of the pool, unregistering them from the
+// plugin.  Connections which are in use are closed when they are returned.
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	var rc error
+	for _, c := range idle {
+		if err := c.Close(); err != nil && rc == nil {
+			rc = err
+		}
+	}
+	return rc
+}
@@ -603,13 +603,17 @@ type Capabilities struct {
 	Cap   string `json:"cap"`
 }
 
-// IsSupported used to determine if a capability is supported
+// IsSupported used to determine if a capability is supported, a capability
+// beyond the end of the set isn't.
 func (c *Capabilities) IsSupported(cap CapabilityType) bool {
-	var capIdx = int32(cap) * 2
-	if c.Cap[capIdx:capIdx+2] == "01" {
-		return true
+	if c == nil {
+		return false
 	}
-	return false
+	var capIdx = uint64(cap) * 2
+	if capIdx+2 > uint64(len(c.Cap)) {
+		return false
+	}
+	return c.Cap[capIdx:capIdx+2] == "01"
 }
 
 // IsSupportedSet is used to determine if 1 or more capabilities
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: 0BSD
+
+package errors
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ErrorCode is the number libStorageMgmt uses to identify an error.  Its
+// textual form is the name libStorageMgmt uses for it, eg. NOT_FOUND_VOLUME.
+type ErrorCode int32
+
+// codeNames lists every code libStorageMgmt defines, and ContextExpired
+// which only this package uses.
+var codeNames = map[ErrorCode]string{
+	Ok:                     "OK",
+	LibBug:                 "LIB_BUG",
+	PluginBug:              "PLUGIN_BUG",
+	JobStarted:             "JOB_STARTED",
+	TimeOut:                "TIMEOUT",
+	DameonNotRunning:       "DAEMON_NOT_RUNNING",
+	PermissionDenied:       "PERMISSION_DENIED",
+	NameConflict:           "NAME_CONFLICT",
+	ExistsInitiator:        "EXISTS_INITIATOR",
+	InvalidArgument:        "INVALID_ARGUMENT",
+	NoStateChange:          "NO_STATE_CHANGE",
+	NetworkConnRefused:     "NETWORK_CONNREFUSED",
+	NetworkHostDown:        "NETWORK_HOSTDOWN",
+	NetworkError:           "NETWORK_ERROR",
+	NoMemory:               "NO_MEMORY",
+	NoSupport:              "NO_SUPPORT",
+	IsMasked:               "IS_MASKED",
+	HasChildDependency:     "HAS_CHILD_DEPENDENCY",
+	NotFoundAccessGroup:    "NOT_FOUND_ACCESS_GROUP",
+	NotFoundFs:             "NOT_FOUND_FS",
+	NotFoundJob:            "NOT_FOUND_JOB",
+	NotFoundPool:           "NOT_FOUND_POOL",
+	NotFoundFsSS:           "NOT_FOUND_FS_SS",
+	NotFoundVolume:         "NOT_FOUND_VOLUME",
+	NotFoundNfsExport:      "NOT_FOUND_NFS_EXPORT",
+	NotFoundGeneric:        "NOT_FOUND_GENERIC",
+	NotFoundSystem:         "NOT_FOUND_SYSTEM",
+	NotFoundDisk:           "NOT_FOUND_DISK",
+	NotLicensed:            "NOT_LICENSED",
+	NoSupportOnlineChange:  "NO_SUPPORT_ONLINE_CHANGE",
+	NoSupportOfflineChange: "NO_SUPPORT_OFFLINE_CHANGE",
+	PluginAuthFailed:       "PLUGIN_AUTH_FAILED",
+	PluginIpcFail:          "PLUGIN_IPC_FAIL",
+	PluginSocketPermission: "PLUGIN_SOCKET_PERMISSION",
+	PluginNotExist:         "PLUGIN_NOT_EXIST",
+	NotEnoughSpace:         "NOT_ENOUGH_SPACE",
+	TransPortCommunication: "TRANSPORT_COMMUNICATION",
+	TransPortSerialization: "TRANSPORT_SERIALIZATION",
+	TransPortInvalidArg:    "TRANSPORT_INVALID_ARG",
+	LastInitInAccessGroup:  "LAST_INIT_IN_ACCESS_GROUP",
+	UnsupportedSearchKey:   "UNSUPPORTED_SEARCH_KEY",
+	EmptyAccessGroup:       "EMPTY_ACCESS_GROUP",
+	PoolNotReady:           "POOL_NOT_READY",
+	DiskNotFree:            "DISK_NOT_FREE",
+	ContextExpired:         "CONTEXT_EXPIRED",
+}
+
+var codeValues = func() map[string]ErrorCode {
+	rc := make(map[string]ErrorCode, len(codeNames))
+	for code, name := range codeNames {
+		rc[name] = code
+	}
+	return rc
+}()
+
+// Codes returns every error code known to this package, in numeric order.
+func Codes() []ErrorCode {
+	rc := make([]ErrorCode, 0, len(codeNames))
+	for code := range codeNames {
+		rc = append(rc, code)
+	}
+	sort.Slice(rc, func(i, j int) bool { return rc[i] < rc[j] })
+	return rc
+}
+
+// String returns the name of the code, or its number for an unknown code.
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return strconv.Itoa(int(c))
+}
+
+// MarshalText returns the name of the code.
+func (c ErrorCode) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText accepts the name or the number of a code.
+func (c *ErrorCode) UnmarshalText(text []byte) error {
+	if code, ok := codeValues[string(text)]; ok {
+		*c = code
+		return nil
+	}
+
+	n, err := strconv.ParseInt(string(text), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid error code %q", text)
+	}
+	*c = ErrorCode(n)
+	return nil
+}
+
+// UnmarshalJSON accepts the number used on the wire as well as the name.
+func (c *ErrorCode) UnmarshalJSON(b []byte) error {
+	var n int32
+	if json.Unmarshal(b, &n) == nil {
+		*c = ErrorCode(n)
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return fmt.Errorf("invalid error code %s", b)
+	}
+	return c.UnmarshalText([]byte(text))
+}
+
+// MarshalJSON keeps the code numeric in the error sent between plugin and
+// client, which is what other libStorageMgmt implementations expect.
+func (e LsmError) MarshalJSON() ([]byte, error) {
+	type Alias LsmError
+	return json.Marshal(&struct {
+		Code int32 `json:"code"`
+		*Alias
+	}{
+		Code:  int32(e.Code),
+		Alias: (*Alias)(&e),
+	})
+}
@@ -2,150 +2,222 @@
 
 package errors
 
-import "fmt"
+import (
+	stderrors "errors"
+	"fmt"
+)
 
 // LsmError returned from JSON API
 type LsmError struct {
-	Code    int32  `json:"code"`
-	Message string `json:"message"`
-	Data    string `json:"data"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Data    string    `json:"data"`
+
+	// Attempts is how many times the call was made when a retry policy
+	// applied to it, zero otherwise.
+	Attempts int `json:"-"`
+
+	// Cause is the error which led to this one, eg. a net.Error when the
+	// plugin couldn't be reached.  It is not sent between plugin and client.
+	Cause error `json:"-"`
 }
 
 func (e *LsmError) Error() string {
+	var rc string
 	if len(e.Data) > 0 {
-		return fmt.Sprintf("code = %d, message = %s, data = %s", e.Code, e.Message, e.Data)
+		rc = fmt.Sprintf("code = %s (%d), message = %s, data = %s", e.Code, e.Code, e.Message, e.Data)
+	} else {
+		rc = fmt.Sprintf("code = %s (%d), message = %s", e.Code, e.Code, e.Message)
 	}
-	return fmt.Sprintf("code = %d, message = %s", e.Code, e.Message)
+
+	if e.Attempts > 1 {
+		rc += fmt.Sprintf(", attempts = %d", e.Attempts)
+	}
+	return rc
+}
+
+// Unwrap returns the cause of the error, if known.
+func (e *LsmError) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is an LsmError with the same code, so that
+// errors.Is(err, ErrNotFoundVolume) matches any error with code
+// NotFoundVolume.
+func (e *LsmError) Is(target error) bool {
+	t, ok := target.(*LsmError)
+	return ok && t.Code == e.Code
+}
+
+// Errorf returns an error with the given code and formatted message, for
+// plugins to return from their callbacks.
+func Errorf(code ErrorCode, format string, args ...interface{}) *LsmError {
+	return &LsmError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap returns an error with the given code and formatted message, carrying
+// the text of err, eg. one returned by the storage array, as its data.  A nil
+// err leaves the data and cause empty.
+func Wrap(code ErrorCode, err error, format string, args ...interface{}) *LsmError {
+	if err == nil {
+		return Errorf(code, format, args...)
+	}
+	return &LsmError{Code: code, Message: fmt.Sprintf(format, args...), Data: err.Error(), Cause: err}
+}
+
+// FromError converts any error into an LsmError.  An LsmError, also one
+// wrapped in other errors, keeps its code, otherwise the code is PluginBug.
+// The text of any wrapping errors is kept as the data.
+func FromError(err error) *LsmError {
+	var lsmError *LsmError
+	if stderrors.As(err, &lsmError) && lsmError != nil {
+		if lsmError == err || len(lsmError.Data) > 0 {
+			return lsmError
+		}
+		return &LsmError{Code: lsmError.Code, Message: lsmError.Message, Data: err.Error(), Cause: err}
+	}
+
+	if err == nil {
+		return &LsmError{Code: PluginBug, Message: "plugin returned a nil error"}
+	}
+	return &LsmError{Code: PluginBug, Message: err.Error(), Cause: err}
 }
 
 const (
 
 	// Ok ... No errors encountered, in this case should likely never be seen
-	Ok int32 = 0
+	Ok ErrorCode = 0
 
 	// LibBug ... Library bug
-	LibBug int32 = 1
+	LibBug ErrorCode = 1
 
 	// PluginBug ... Bug found in plugin
-	PluginBug int32 = 2
+	PluginBug ErrorCode = 2
 
 	// JobStarted ... Job has been started
-	JobStarted int32 = 7
+	JobStarted ErrorCode = 7
 
 	// TimeOut ... Plugin timeout
-	TimeOut int32 = 11
+	TimeOut ErrorCode = 11
 
 	// DameonNotRunning ... lsmd does not appear to be running
-	DameonNotRunning int32 = 12
+	DameonNotRunning ErrorCode = 12
 
 	// PermissionDenied Insufficient permission
-	PermissionDenied int32 = 13
+	PermissionDenied ErrorCode = 13
 
 	// NameConflict Request has a duplicate named resource
-	NameConflict int32 = 50
+	NameConflict ErrorCode = 50
 
 	// ExistsInitiator ... Initiator already exists in group
-	ExistsInitiator int32 = 52
+	ExistsInitiator ErrorCode = 52
 
 	// InvalidArgument ... provided argument is incorrect
-	InvalidArgument int32 = 101
+	InvalidArgument ErrorCode = 101
 
 	// NoStateChange ... Request resulted in no change of storage state
-	NoStateChange int32 = 125
+	NoStateChange ErrorCode = 125
 
 	// NetworkConnRefused ... Network connection was refused
-	NetworkConnRefused int32 = 140
+	NetworkConnRefused ErrorCode = 140
 
 	// NetworkHostDown ... Networked host is not reachable on network
-	NetworkHostDown int32 = 141
+	NetworkHostDown ErrorCode = 141
 
 	// NetworkError ... Generic network error
-	NetworkError int32 = 142
+	NetworkError ErrorCode = 142
 
 	// NoMemory ... Library encountered an out of memory condition
-	NoMemory int32 = 152
+	NoMemory ErrorCode = 152
 
 	// NoSupport operation not supported
-	NoSupport int32 = 153
+	NoSupport ErrorCode = 153
 
 	// IsMasked ... Volume is masked to an access group
-	IsMasked int32 = 160
+	IsMasked ErrorCode = 160
 
 	// HasChildDependency ... Volume/File system has a child dependency
-	HasChildDependency int32 = 161
+	HasChildDependency ErrorCode = 161
 
 	// NotFoundAccessGroup ... The specified access group was not found
-	NotFoundAccessGroup int32 = 200
+	NotFoundAccessGroup ErrorCode = 200
 
 	// NotFoundFs ... The specified file system was not found
-	NotFoundFs int32 = 201
+	NotFoundFs ErrorCode = 201
 
 	// NotFoundJob ... The specified job was not found
-	NotFoundJob int32 = 202
+	NotFoundJob ErrorCode = 202
 
 	// NotFoundPool ... The specified pool was not found
-	NotFoundPool int32 = 203
+	NotFoundPool ErrorCode = 203
 
 	// NotFoundFsSs ... The specified file system/snap shot was not found
-	NotFoundFsSS int32 = 204
+	NotFoundFsSS ErrorCode = 204
 
 	// NotFoundVolume ... The specified volume was not found
-	NotFoundVolume int32 = 205
+	NotFoundVolume ErrorCode = 205
 
 	// NotFoundNfsExport ... The specified NFS export was not found
-	NotFoundNfsExport int32 = 206
+	NotFoundNfsExport ErrorCode = 206
 
 	// NotFoundGeneric ...A non-specific resource was not found
-	NotFoundGeneric int32 = 207
+	NotFoundGeneric ErrorCode = 207
 
 	// NotFoundSystem ... The specified system was not found
-	NotFoundSystem int32 = 208
+	NotFoundSystem ErrorCode = 208
 
 	// NotFoundDisk ... The specified disk was not found
-	NotFoundDisk int32 = 209
+	NotFoundDisk ErrorCode = 209
 
 	// NotLicensed ... The required functionality is not licensed
-	NotLicensed int32 = 226
+	NotLicensed ErrorCode = 226
 
 	// NoSupportOnlineChange ... The specified operation requires offline
-	NoSupportOnlineChange int32 = 250
+	NoSupportOnlineChange ErrorCode = 250
 
 	// NoSupportOfflineChange ... The specified operation requires online
-	NoSupportOfflineChange int32 = 251
+	NoSupportOfflineChange ErrorCode = 251
 
 	// PluginAuthFailed Plugin failed to authenticate
-	PluginAuthFailed int32 = 300
+	PluginAuthFailed ErrorCode = 300
+
+	// PluginIpcFail ... Error communicating with plugin
+	PluginIpcFail ErrorCode = 301
 
 	// PluginSocketPermission ... Incorrect permission on UNIX domain socket used for IPC
-	PluginSocketPermission int32 = 307
+	PluginSocketPermission ErrorCode = 307
 
 	// PluginNotExist ... Plugin doesn't apprear to exist
-	PluginNotExist int32 = 311
+	PluginNotExist ErrorCode = 311
 
 	// NotEnoughSpace ... Insufficient space to complete the request
-	NotEnoughSpace int32 = 350
+	NotEnoughSpace ErrorCode = 350
 
 	//TransPortCommunication ... Issue reading/writing to plugin
-	TransPortCommunication int32 = 400
+	TransPortCommunication ErrorCode = 400
 
 	// TransPortSerialization ... Issue with serializing the payload of a request
-	TransPortSerialization int32 = 401
+	TransPortSerialization ErrorCode = 401
 
 	// TransPortInvalidArg parameter transported over IPC is invalid
-	TransPortInvalidArg int32 = 402
+	TransPortInvalidArg ErrorCode = 402
 
 	// LastInitInAccessGroup ... refuse to remove the last initiator from access group
-	LastInitInAccessGroup int32 = 502
+	LastInitInAccessGroup ErrorCode = 502
 
 	// UnsupportedSearchKey ... The specified search key is not supported
-	UnsupportedSearchKey int32 = 510
+	UnsupportedSearchKey ErrorCode = 510
 
 	// EmptyAccessGroup ... volume_mask() will fail if access group has no member/initiator
-	EmptyAccessGroup int32 = 511
+	EmptyAccessGroup ErrorCode = 511
 
 	// PoolNotReady ... Pool is not ready for create/resize/etc
-	PoolNotReady int32 = 512
+	PoolNotReady ErrorCode = 512
 
 	// DiskNotFree ... Disk is not in DiskStatusFree status
-	DiskNotFree int32 = 513
+	DiskNotFree ErrorCode = 513
+
+	// ContextExpired ... The context of the call was cancelled or its deadline passed,
+	// this is generated by this library and never sent by a plugin
+	ContextExpired ErrorCode = 1000
 )
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: 0BSD
+
+package errors
+
+import (
+	stderrors "errors"
+)
+
+// Sentinel errors, one per code, for use with errors.Is.  Any LsmError
+// matches the sentinel with the same code whatever its message.
+var (
+	ErrLibBug                 = &LsmError{Code: LibBug, Message: "library bug"}
+	ErrPluginBug              = &LsmError{Code: PluginBug, Message: "plugin bug"}
+	ErrJobStarted             = &LsmError{Code: JobStarted, Message: "job started"}
+	ErrTimeOut                = &LsmError{Code: TimeOut, Message: "plugin timeout"}
+	ErrDameonNotRunning       = &LsmError{Code: DameonNotRunning, Message: "lsmd not running"}
+	ErrPermissionDenied       = &LsmError{Code: PermissionDenied, Message: "permission denied"}
+	ErrNameConflict           = &LsmError{Code: NameConflict, Message: "name conflict"}
+	ErrExistsInitiator        = &LsmError{Code: ExistsInitiator, Message: "initiator exists"}
+	ErrInvalidArgument        = &LsmError{Code: InvalidArgument, Message: "invalid argument"}
+	ErrNoStateChange          = &LsmError{Code: NoStateChange, Message: "no state change"}
+	ErrNetworkConnRefused     = &LsmError{Code: NetworkConnRefused, Message: "connection refused"}
+	ErrNetworkHostDown        = &LsmError{Code: NetworkHostDown, Message: "host down"}
+	ErrNetworkError           = &LsmError{Code: NetworkError, Message: "network error"}
+	ErrNoMemory               = &LsmError{Code: NoMemory, Message: "no memory"}
+	ErrNoSupport              = &LsmError{Code: NoSupport, Message: "not supported"}
+	ErrIsMasked               = &LsmError{Code: IsMasked, Message: "volume is masked"}
+	ErrHasChildDependency     = &LsmError{Code: HasChildDependency, Message: "has child dependency"}
+	ErrNotFoundAccessGroup    = &LsmError{Code: NotFoundAccessGroup, Message: "access group not found"}
+	ErrNotFoundFs             = &LsmError{Code: NotFoundFs, Message: "file system not found"}
+	ErrNotFoundJob            = &LsmError{Code: NotFoundJob, Message: "job not found"}
+	ErrNotFoundPool           = &LsmError{Code: NotFoundPool, Message: "pool not found"}
+	ErrNotFoundFsSS           = &LsmError{Code: NotFoundFsSS, Message: "file system snapshot not found"}
+	ErrNotFoundVolume         = &LsmError{Code: NotFoundVolume, Message: "volume not found"}
+	ErrNotFoundNfsExport      = &LsmError{Code: NotFoundNfsExport, Message: "NFS export not found"}
+	ErrNotFoundGeneric        = &LsmError{Code: NotFoundGeneric, Message: "not found"}
+	ErrNotFoundSystem         = &LsmError{Code: NotFoundSystem, Message: "system not found"}
+	ErrNotFoundDisk           = &LsmError{Code: NotFoundDisk, Message: "disk not found"}
+	ErrNotLicensed            = &LsmError{Code: NotLicensed, Message: "not licensed"}
+	ErrNoSupportOnlineChange  = &LsmError{Code: NoSupportOnlineChange, Message: "online change not supported"}
+	ErrNoSupportOfflineChange = &LsmError{Code: NoSupportOfflineChange, Message: "offline change not supported"}
+	ErrPluginAuthFailed       = &LsmError{Code: PluginAuthFailed, Message: "plugin authentication failed"}
+	ErrPluginIpcFail          = &LsmError{Code: PluginIpcFail, Message: "plugin IPC failure"}
+	ErrPluginSocketPermission = &LsmError{Code: PluginSocketPermission, Message: "plugin socket permission"}
+	ErrPluginNotExist         = &LsmError{Code: PluginNotExist, Message: "plugin does not exist"}
+	ErrNotEnoughSpace         = &LsmError{Code: NotEnoughSpace, Message: "not enough space"}
+	ErrTransPortCommunication = &LsmError{Code: TransPortCommunication, Message: "plugin communication error"}
+	ErrTransPortSerialization = &LsmError{Code: TransPortSerialization, Message: "serialization error"}
+	ErrTransPortInvalidArg    = &LsmError{Code: TransPortInvalidArg, Message: "invalid argument in transport"}
+	ErrLastInitInAccessGroup  = &LsmError{Code: LastInitInAccessGroup, Message: "last initiator in access group"}
+	ErrUnsupportedSearchKey   = &LsmError{Code: UnsupportedSearchKey, Message: "unsupported search key"}
+	ErrEmptyAccessGroup       = &LsmError{Code: EmptyAccessGroup, Message: "empty access group"}
+	ErrPoolNotReady           = &LsmError{Code: PoolNotReady, Message: "pool not ready"}
+	ErrDiskNotFree            = &LsmError{Code: DiskNotFree, Message: "disk not free"}
+	ErrContextExpired         = &LsmError{Code: ContextExpired, Message: "context expired"}
+)
+
+// Code returns the code of the first LsmError in the chain of err.
+func Code(err error) (ErrorCode, bool) {
+	var lsmError *LsmError
+	if stderrors.As(err, &lsmError) && lsmError != nil {
+		return lsmError.Code, true
+	}
+	return 0, false
+}
+
+func hasCode(err error, codes ...ErrorCode) bool {
+	if c, ok := Code(err); ok {
+		for _, code := range codes {
+			if c == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err is about something which doesn't exist.
+func IsNotFound(err error) bool {
+	return hasCode(err, NotFoundAccessGroup, NotFoundFs, NotFoundJob, NotFoundPool, NotFoundFsSS,
+		NotFoundVolume, NotFoundNfsExport, NotFoundGeneric, NotFoundSystem, NotFoundDisk)
+}
+
+// IsRetryable reports whether err is transient, so the call may succeed if
+// made again later.
+func IsRetryable(err error) bool {
+	return hasCode(err, TimeOut, NetworkError, NetworkHostDown, PoolNotReady)
+}
+
+// IsNoSupport reports whether err is because the plugin or array doesn't
+// support what was asked.
+func IsNoSupport(err error) bool {
+	return hasCode(err, NoSupport, NoSupportOnlineChange, NoSupportOfflineChange)
+}
+
+// IsTransport reports whether err is because the plugin couldn't be talked
+// to, rather than the plugin reporting a problem.
+func IsTransport(err error) bool {
+	return hasCode(err, TransPortCommunication, TransPortSerialization, TransPortInvalidArg,
+		DameonNotRunning, PluginIpcFail, PluginNotExist, PluginSocketPermission)
+}
@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// CapabilityGuard checks a call is supported by the system it concerns
+// before it is sent to the plugin, see ClientConnection.CapabilityGuardAdd.
+type CapabilityGuard struct {
+	mu      sync.Mutex
+	systems map[string]*System
+	caps    map[string]*guardEntry
+}
+
+// guardEntry holds the capabilities of a system, done is closed once they
+// have been retrieved or retrieving them has failed.
+type guardEntry struct {
+	done chan struct{}
+	caps *Capabilities
+	err  error
+}
+
+// required returns the capabilities a call needs, given its arguments.
+type required func(args map[string]interface{}) []CapabilityType
+
+func needs(caps ...CapabilityType) required {
+	return func(args map[string]interface{}) []CapabilityType {
+		return caps
+	}
+}
+
+// plus returns the capabilities of r, followed by those of variant for the
+// value of the argument key, if any.
+func (r required) plus(key string, variant map[interface{}]CapabilityType) required {
+	return func(args map[string]interface{}) []CapabilityType {
+		rc := r(args)
+		if cap, ok := variant[args[key]]; ok {
+			rc = append(rc, cap)
+		}
+		return rc
+	}
+}
+
+// capabilityTable lists the capabilities needed by each plugin method whose
+// arguments say which system the call concerns.
+var capabilityTable = map[string]required{
+	"volume_create": needs(CapVolumeCreate).plus("provisioning", map[interface{}]CapabilityType{
+		VolumeProvisionTypeThin: CapVolumeThin}),
+	"volume_delete": needs(CapVolumeDelete),
+	"volume_resize": needs(CapVolumeCResize),
+	"volume_replicate": needs(CapVolumeCReplicate).plus("rep_type", map[interface{}]CapabilityType{
+		VolumeReplicateTypeClone:       CapVolumeCReplicateClone,
+		VolumeReplicateTypeCopy:        CapVolumeCReplicateCopy,
+		VolumeReplicateTypeMirrorAsync: CapVolumeCReplicateMirrorAsync,
+		VolumeReplicateTypeMirrorSync:  CapVolumeCReplicateMirrorSync}),
+	"volume_replicate_range_block_size": needs(CapVolumeCopyRangeBlockSize),
+	"volume_replicate_range": needs(CapVolumeCopyRange).plus("rep_type", map[interface{}]CapabilityType{
+		VolumeReplicateTypeClone: CapVolumeCopyRangeClone,
+		VolumeReplicateTypeCopy:  CapVolumeCopyRangeCopy}),
+	"volume_enable":                      needs(CapVolumeEnable),
+	"volume_disable":                     needs(CapVolumeDisable),
+	"volume_mask":                        needs(CapVolumeMask),
+	"volume_unmask":                      needs(CapVolumeUnmask),
+	"volumes_accessible_by_access_group": needs(CapVolumesMaskedToAg),
+	"access_groups_granted_to_volume":    needs(CapAgsGrantedToVol),
+	"volume_child_dependency":            needs(CapHasChildDep),
+	"volume_child_dependency_rm":         needs(CapChildDepRm),
+	"access_group_create": needs().plus("init_type", map[interface{}]CapabilityType{
+		InitiatorTypeWwpn:     CapAccessGroupCreateWwpn,
+		InitiatorTypeIscsiIqn: CapAccessGroupCreateIscsiIqn}),
+	"access_group_delete": needs(CapAccessGroupDelete),
+	"access_group_initiator_add": needs().plus("init_type", map[interface{}]CapabilityType{
+		InitiatorTypeWwpn:     CapAccessGroupInitiatorAddWwpn,
+		InitiatorTypeIscsiIqn: CapAccessGroupInitAddIscsiIqn}),
+	"access_group_initiator_delete":     needs(CapAccessGroupInitiatorDel),
+	"volume_raid_info":                  needs(CapVolRaidInfo),
+	"pool_member_info":                  needs(CapPoolMemberInfo),
+	"volume_raid_create_cap_get":        needs(CapVolumeRaidCreate),
+	"volume_raid_create":                needs(CapVolumeRaidCreate),
+	"volume_ident_led_on":               needs(CapVolumeLed),
+	"volume_ident_led_off":              needs(CapVolumeLed),
+	"volume_cache_info":                 needs(CapVolCacheInfo),
+	"volume_physical_disk_cache_update": needs(CapVolPhyDiskCacheSet),
+	"volume_write_cache_policy_update": needs().plus("wcp", map[interface{}]CapabilityType{
+		WriteCachePolicyWriteBack:    CapVolWriteCacheSetEnable,
+		WriteCachePolicyAuto:         CapVolWriteCacheSetAuto,
+		WriteCachePolicyWriteThrough: CapVolWriteCacheSetDisabled}),
+	"volume_read_cache_policy_update": needs(CapVolReadCacheSet),
+	"system_read_cache_pct_update":    needs(CapSysReadCachePctSet),
+	"fs_create":                       needs(CapFsCreate),
+	"fs_delete":                       needs(CapFsDelete),
+	"fs_resize":                       needs(CapFsResize),
+	"fs_clone":                        needs(CapFsClone),
+	"fs_file_clone":                   needs(CapFsFileClone),
+	"fs_snapshots":                    needs(CapFsSnapshots),
+	"fs_snapshot_create":              needs(CapFsSnapshotCreate),
+	"fs_snapshot_delete":              needs(CapFsSnapshotDelete),
+	"fs_snapshot_restore": needs(CapFsSnapshotRestore).plus("all_files", map[interface{}]CapabilityType{
+		false: CapFsSnapshotRestoreSpecificFiles}),
+	"fs_child_dependency": needs(CapFsHasChildDep),
+	"fs_child_dependency_rm": func(args map[string]interface{}) []CapabilityType {
+		if files, _ := args["files"].([]string); len(files) > 0 {
+			return []CapabilityType{CapFsChildDepRm, CapFsChildDepRmSpecificFiles}
+		}
+		return []CapabilityType{CapFsChildDepRm}
+	},
+}
+
+// RequiredCapabilities returns the capabilities the plugin method needs to
+// be supported for a call with the given arguments, nil for methods the
+// guard doesn't check.
+func RequiredCapabilities(method string, args map[string]interface{}) []CapabilityType {
+	if r, ok := capabilityTable[method]; ok {
+		return r(args)
+	}
+	return nil
+}
+
+// systemOf returns the ID of the system a call concerns, taken from the
+// first of its arguments identifying one.
+func systemOf(args map[string]interface{}) (string, bool) {
+	for _, key := range []string{"system", "volume", "volume_src", "pool", "fs", "src_fs", "access_group", "disks"} {
+		switch o := args[key].(type) {
+		case System:
+			return o.ID, true
+		case Volume:
+			return o.SystemID, true
+		case Pool:
+			return o.SystemID, true
+		case FileSystem:
+			return o.SystemID, true
+		case AccessGroup:
+			return o.SystemID, true
+		case []Disk:
+			if len(o) > 0 {
+				return o[0].SystemID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// CapabilityGuardAdd makes every call on the connection, including copies,
+// check the capabilities of the system it concerns first.  A call the system
+// doesn't support fails with NoSupport naming the missing capability without
+// reaching the plugin.  Capabilities are retrieved once per system and kept
+// until Forget.  Calls not concerning a particular system, eg. listing
+// volumes, aren't checked.
+func (c *ClientConnection) CapabilityGuardAdd() *CapabilityGuard {
+	g := &CapabilityGuard{systems: make(map[string]*System), caps: make(map[string]*guardEntry)}
+	c.InterceptorAdd(g.intercept)
+	return g
+}
+
+// Forget drops the capabilities kept for a system, eg. after its firmware
+// has changed, an empty ID drops those of every system.
+func (g *CapabilityGuard) Forget(systemID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(systemID) == 0 {
+		g.systems = make(map[string]*System)
+		g.caps = make(map[string]*guardEntry)
+		return
+	}
+	delete(g.systems, systemID)
+	delete(g.caps, systemID)
+}
+
+func (g *CapabilityGuard) intercept(ctx context.Context, method string, args map[string]interface{},
+	result interface{}, next Invoker) error {
+
+	needed := RequiredCapabilities(method, args)
+	systemID, ok := systemOf(args)
+	if len(needed) == 0 || !ok {
+		return next(ctx, method, args, result)
+	}
+
+	caps, err := g.capabilities(ctx, systemID, next)
+	if err != nil {
+		return err
+	}
+	for _, cap := range needed {
+		if !caps.IsSupported(cap) {
+			return &errors.LsmError{
+				Code: errors.NoSupport,
+				Message: fmt.Sprintf("%s needs capability %v which system %s doesn't support",
+					method, cap, systemID)}
+		}
+	}
+	return next(ctx, method, args, result)
+}
+
+// capabilities returns those of the system, retrieving them with next the
+// first time.  Concurrent callers for the same system wait for a single
+// retrieval, which is made without holding g.mu so calls concerning other
+// systems aren't held up.  A failed retrieval isn't kept.
+func (g *CapabilityGuard) capabilities(ctx context.Context, systemID string, next Invoker) (*Capabilities, error) {
+	for {
+		g.mu.Lock()
+		e, ok := g.caps[systemID]
+		if !ok {
+			e = &guardEntry{done: make(chan struct{})}
+			g.caps[systemID] = e
+		}
+		g.mu.Unlock()
+
+		if !ok {
+			caps, err := g.retrieve(ctx, systemID, next)
+			g.mu.Lock()
+			e.caps, e.err = caps, err
+			if err != nil && g.caps[systemID] == e {
+				delete(g.caps, systemID)
+			}
+			g.mu.Unlock()
+			close(e.done)
+			return caps, err
+		}
+
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, contextError("capabilities", ctx.Err())
+		}
+		// The retrieval we waited on may have failed only because of the
+		// context of its caller, so try again ourselves.
+		if e.err == nil {
+			return e.caps, nil
+		}
+	}
+}
+
+// retrieve gets the capabilities of the system from the plugin, looking the
+// system up first if it isn't known yet.
+func (g *CapabilityGuard) retrieve(ctx context.Context, systemID string, next Invoker) (*Capabilities, error) {
+	g.mu.Lock()
+	system, ok := g.systems[systemID]
+	g.mu.Unlock()
+
+	if !ok {
+		var systems []System
+		if err := next(ctx, "systems", map[string]interface{}{}, &systems); err != nil {
+			return nil, err
+		}
+		g.mu.Lock()
+		for i := range systems {
+			g.systems[systems[i].ID] = &systems[i]
+		}
+		system, ok = g.systems[systemID]
+		g.mu.Unlock()
+		if !ok {
+			return nil, notFound(errors.NotFoundSystem, "system", "ID", systemID)
+		}
+	}
+
+	var caps Capabilities
+	if err := next(ctx, "capabilities", map[string]interface{}{"system": *system}, &caps); err != nil {
+		return nil, err
+	}
+	return &caps, nil
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"context"
+	"sync"
+)
+
+// Invoker makes one call to the plugin, method is the name of the plugin
+// method, eg. "volumes".  The reply is decoded into result, which is a
+// pointer or nil if the method returns nothing of interest.
+type Invoker func(ctx context.Context, method string, args map[string]interface{}, result interface{}) error
+
+// Interceptor wraps every call made with a ClientConnection.  It continues
+// the call by calling next, which may be the next interceptor or the plugin,
+// and may inspect or change the arguments, result and error on the way.  Not
+// calling next short-circuits the call, the interceptor is then responsible
+// for filling in result or returning an error.
+type Interceptor func(ctx context.Context, method string, args map[string]interface{}, result interface{},
+	next Invoker) error
+
+// interceptors is shared by all copies of a connection.
+type interceptors struct {
+	mu   sync.RWMutex
+	list []Interceptor
+}
+
+// InterceptorAdd appends interceptors to those applied to every call on the
+// connection, including copies made with WithContext.  Interceptors run in
+// the order they were added, the first one added sees a call first and its
+// outcome last.
+func (c *ClientConnection) InterceptorAdd(interceptor ...Interceptor) {
+	c.chain.mu.Lock()
+	defer c.chain.mu.Unlock()
+	c.chain.list = append(c.chain.list, interceptor...)
+}
+
+// wrap returns invoker preceded by all the interceptors.
+func (i *interceptors) wrap(invoker Invoker) Invoker {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for n := len(i.list) - 1; n >= 0; n-- {
+		interceptor, next := i.list[n], invoker
+		invoker = func(ctx context.Context, method string, args map[string]interface{}, result interface{}) error {
+			return interceptor(ctx, method, args, result, next)
+		}
+	}
+	return invoker
+}
@@ -3,11 +3,15 @@
 package libstoragemgmt
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
-	"os"
-	"strconv"
+	"sync"
+	"time"
 
 	errors "github.com/libstorage/libstoragemgmt-golang/errors"
 )
@@ -15,116 +19,466 @@ import (
 const (
 	udsPathVarName = "LSM_UDS_PATH"
 	udsPathDefault = "/var/run/lsm/ipc"
-	headerLen      = 10
+
+	// legacyID is the fixed request ID used by older clients and plugins,
+	// replies carrying it can't be correlated with a request.
+	legacyID = 100
 )
 
+// DefaultTimeOutGrace is how much longer than the plugin timeout we wait for
+// a reply before giving up on the plugin.
+const DefaultTimeOutGrace = 5 * time.Second
+
+// transPort is safe for concurrent use, invoke serializes requests as the
+// protocol only allows one outstanding request per connection.
 type transPort struct {
-	uds   net.Conn
-	debug bool
+	mu       sync.Mutex
+	conn     Transport
+	log      Logger
+	timeout  uint32
+	grace    time.Duration
+	failed   error
+	lastID   int
+	maxFrame int
+}
+
+func newTransport(ctx context.Context, pluginUdsPath string, checkErrors bool) (*transPort, error) {
+	c, cError := dial(ctx, pluginUdsPath, checkErrors)
+	if cError != nil {
+		return nil, cError
+	}
+	return newTransPort(c), nil
+}
+
+func newTransPort(c Transport) *transPort {
+	return &transPort{conn: c, log: envLogger(), grace: DefaultTimeOutGrace, lastID: legacyID}
 }
 
-func newTransport(pluginUdsPath string, checkErrors bool) (*transPort, error) {
-	var c, cError = net.Dial("unix", pluginUdsPath)
+func dial(ctx context.Context, pluginUdsPath string, checkErrors bool) (Transport, error) {
+	var d net.Dialer
+	var c, cError = d.DialContext(ctx, "unix", pluginUdsPath)
 	if cError != nil {
 
+		if ctx.Err() != nil {
+			return nil, contextError("connect", ctx.Err())
+		}
+
 		// checkDaemonExists calls newTransport, to prevent unbounded recursion we
 		// don't want to check while we are checking :-)
 		if checkErrors {
 			if checkDaemonExists() {
 				return nil, &errors.LsmError{
 					Code:    errors.PluginNotExist,
-					Message: fmt.Sprintf("plug-in %s not found!", pluginUdsPath)}
+					Message: fmt.Sprintf("plug-in %s not found!", pluginUdsPath),
+					Cause:   cError}
 			}
 
 			return nil, &errors.LsmError{
 				Code:    errors.DameonNotRunning,
-				Message: fmt.Sprintf("The libStorageMgmt daemon is not running (process name lsmd) when trying to connect to: %s", pluginUdsPath)}
+				Message: fmt.Sprintf("The libStorageMgmt daemon is not running (process name lsmd) when trying to connect to: %s", pluginUdsPath),
+				Cause:   cError}
 		}
 
 		return nil, cError
 	}
+	return envRecorder(NewConnTransport(c)), nil
+}
+
+func (t *transPort) close() {
+	t.conn.Close()
+}
+
+// reset replaces a failed transport with a new one.
+func (t *transPort) reset(c Transport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn.Close()
+	t.conn = c
+	t.failed = nil
+	t.applyMaxFrame()
+}
+
+// fail marks the connection as unusable.
+func (t *transPort) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed = err
+}
 
-	debug := len(os.Getenv("LSM_GO_DEBUG")) > 0
-	return &transPort{uds: c, debug: debug}, nil
+// usable returns false once an exchange with the plugin has failed in a way
+// that leaves the connection out of step.
+func (t *transPort) usable() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed == nil
 }
 
-func (t transPort) close() {
-	t.uds.Close()
+func (t *transPort) timeoutSet(timeout uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeout = timeout
+}
+
+func (t *transPort) timeoutGet() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeout
+}
+
+func (t *transPort) graceSet(grace time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.grace = grace
+}
+
+// maxFrameSizeSet limits the size of the messages accepted, if the transport
+// supports it.
+func (t *transPort) maxFrameSizeSet(size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxFrame = size
+	t.applyMaxFrame()
+}
+
+func (t *transPort) applyMaxFrame() {
+	if l, ok := t.conn.(FrameSizeLimiter); ok && t.maxFrame > 0 {
+		l.MaxFrameSizeSet(t.maxFrame)
+	}
+}
+
+func (t *transPort) loggerSet(l Logger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.log = l
+}
+
+func (t *transPort) graceGet() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.grace
 }
 
 type responseMsg struct {
-	ID     int              `json:"id"`
-	Error  *errors.LsmError `json:"error"`
-	Result json.RawMessage  `json:"result"`
+	ID          int
+	Error       *errors.LsmError
+	hasResult   bool
+	resultError error
+	decodeError error
 }
 
 type requestMsg struct {
 	ID     int             `json:"id"`
 	Method string          `json:"method"`
 	Params json.RawMessage `json:"params"`
+	size   int
 }
 
 func (r *requestMsg) String() string {
 	return fmt.Sprintf("ID: %d, Method: %s, Parms: %s", r.ID, r.Method, string(r.Params))
 }
 
-func (t *transPort) invoke(cmd string, args map[string]interface{}, result interface{}) error {
+func contextError(cmd string, err error) error {
+	return &errors.LsmError{
+		Code:    errors.ContextExpired,
+		Message: fmt.Sprintf("%s aborted: %s", cmd, err),
+		Cause:   err}
+}
+
+// deadline returns the point in time after which we give up waiting on the
+// plugin, which is the connection timeout plus the grace period, or the
+// deadline of ctx if that is sooner.  A zero time is returned if there is
+// no limit.
+func (t *transPort) deadline(ctx context.Context) time.Time {
+	var rc time.Time
+	if t.timeout > 0 {
+		rc = time.Now().Add(time.Duration(t.timeout)*time.Millisecond + t.grace)
+	}
+
+	if ctxDeadline, ok := ctx.Deadline(); ok && (rc.IsZero() || ctxDeadline.Before(rc)) {
+		rc = ctxDeadline
+	}
+	return rc
+}
+
+// watch applies the deadline and cancellation of ctx to the transport so that
+// a blocked read or write returns as soon as ctx is done or the connection
+// timeout expires.  The returned function must be called once the
+// exchange has completed.
+func (t *transPort) watch(ctx context.Context) func() {
+	deadline := t.deadline(ctx)
+	if !deadline.IsZero() {
+		t.conn.SetDeadline(deadline)
+	}
+
+	if ctx.Done() == nil {
+		return func() {
+			if !deadline.IsZero() {
+				t.conn.SetDeadline(time.Time{})
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// A deadline in the past unblocks any pending I/O
+			t.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+		close(stopped)
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		t.conn.SetDeadline(time.Time{})
+	}
+}
+
+// ioError records and returns the error for a failed read or write with the
+// plugin.  Once this has happened we no longer know where the next reply
+// starts in the stream, so the connection is unusable from then on.  An
+// errors.LsmError from the transport is kept as it is.
+func (t *transPort) ioError(ctx context.Context, cmd string, op string, err error) error {
+	var timedOut = false
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		timedOut = true
+	}
 
-	args["flags"] = 0
+	if lsmError, ok := err.(*errors.LsmError); ok {
+		t.failed = lsmError
+	} else if ctx.Err() != nil {
+		t.failed = contextError(cmd, ctx.Err())
+	} else if ctxDeadline, ok := ctx.Deadline(); timedOut && ok && !time.Now().Before(ctxDeadline) {
+		t.failed = contextError(cmd, context.DeadlineExceeded)
+	} else if timedOut {
+		t.failed = &errors.LsmError{
+			Code: errors.TimeOut,
+			Message: fmt.Sprintf("%s: no reply from plugin within timeout of %d ms (+%s)",
+				cmd, t.timeout, t.grace),
+			Cause: err}
+	} else {
+		t.failed = &errors.LsmError{
+			Code:    errors.TransPortCommunication,
+			Message: fmt.Sprintf("Error %s plugin %s\n", op, err),
+			Cause:   err}
+	}
+	return t.failed
+}
+
+func (t *transPort) invoke(ctx context.Context, cmd string, args map[string]interface{}, result interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start := time.Now()
+	id, size, err := t.exchange(ctx, cmd, args, result)
+	if t.log != nil {
+		record := callRecord(cmd, id, args, start, size, err)
+		if t.failed != nil {
+			t.log.Error("call failed, connection unusable", record...)
+		} else {
+			t.log.Debug("call", record...)
+		}
+	}
+	return err
+}
+
+// exchange sends one request and reads the reply, returning the ID and size
+// of the request.
+func (t *transPort) exchange(ctx context.Context, cmd string, args map[string]interface{},
+	result interface{}) (int, int, error) {
+
+	if t.failed != nil {
+		return 0, 0, &errors.LsmError{
+			Code:    errors.TransPortCommunication,
+			Message: fmt.Sprintf("connection unusable after previous error: %s", t.failed)}
+	}
+
+	if ctxError := ctx.Err(); ctxError != nil {
+		return 0, 0, contextError(cmd, ctxError)
+	}
+
+	unwatch := t.watch(ctx)
+	defer unwatch()
+
+	t.lastID++
+	id := t.lastID
+
+	if _, ok := args["flags"]; !ok {
+		args["flags"] = 0
+	}
 	msg := map[string]interface{}{
 		"method": cmd,
-		"id":     100,
+		"id":     id,
 		"params": args,
 	}
 
 	var msgSerialized, serialError = json.Marshal(msg)
 	if serialError != nil {
-		return &errors.LsmError{
+		return id, 0, &errors.LsmError{
 			Code:    errors.LibBug,
-			Message: fmt.Sprintf("Errors serializing parameters %s\n", serialError)}
+			Message: fmt.Sprintf("Errors serializing parameters %s\n", serialError),
+			Cause:   serialError}
 	}
 
 	if sendError := t.send(string(msgSerialized)); sendError != nil {
-		return &errors.LsmError{
-			Code:    errors.TransPortCommunication,
-			Message: fmt.Sprintf("Error writing to unix domain socket %s\n", sendError)}
+		return id, len(msgSerialized), t.ioError(ctx, cmd, "writing to", sendError)
 	}
 
-	var reply, replyError = t.recv()
+	what, replyError := t.recvReply(id, result)
 	if replyError != nil {
-		return &errors.LsmError{
-			Code:    errors.TransPortCommunication,
-			Message: fmt.Sprintf("Error reading from unix domain socket %s\n", replyError)}
+		return id, len(msgSerialized), t.ioError(ctx, cmd, "reading from", replyError)
 	}
 
-	var what responseMsg
-	if replyUnmarsal := json.Unmarshal(reply, &what); replyUnmarsal != nil {
-		return &errors.LsmError{
+	if what.decodeError != nil {
+		return id, len(msgSerialized), &errors.LsmError{
 			Code:    errors.PluginBug,
-			Message: fmt.Sprintf("Unparsable response from plugin %s\n", replyUnmarsal)}
+			Message: fmt.Sprintf("Unparsable response from plugin %s\n", what.decodeError),
+			Cause:   what.decodeError}
+	}
+
+	// Plugins predating request IDs always reply with legacyID, anything else
+	// must be the reply to this request or the stream is out of step.
+	if what.ID != id && what.ID != legacyID {
+		t.failed = &errors.LsmError{
+			Code:    errors.TransPortCommunication,
+			Message: fmt.Sprintf("%s: reply ID %d does not match request ID %d", cmd, what.ID, id)}
+		return id, len(msgSerialized), t.failed
 	}
 
 	if what.Error != nil {
-		return what.Error
+		return id, len(msgSerialized), what.Error
+	}
+
+	if what.resultError != nil {
+		return id, len(msgSerialized), &errors.LsmError{
+			Code: errors.PluginBug,
+			Message: fmt.Sprintf("Plugin returned unexpected response form for (%s): %s",
+				cmd, what.resultError),
+			Cause: what.resultError}
 	}
 
-	if what.Result != nil {
-		// We have a result, parse and return it.
-		var unmarshalResult = json.Unmarshal(what.Result, &result)
-		if unmarshalResult != nil {
-			return &errors.LsmError{
-				Code: errors.PluginBug,
-				Message: fmt.Sprintf("Plugin returned unexpected response form for (%s) data (%s)",
-					cmd, string(what.Result))}
+	if !what.hasResult {
+		return id, len(msgSerialized), &errors.LsmError{
+			Code:    errors.PluginBug,
+			Message: fmt.Sprintf("Unexpected response from plugin for (%s), no result\n", cmd)}
+	}
+
+	return id, len(msgSerialized), nil
+}
+
+// recvReply reads the next reply, decoding its result directly into result
+// as it arrives if it is the reply to request id.  Problems with the content
+// of the reply are recorded in it, the returned error is for failing to read
+// the reply.
+func (t *transPort) recvReply(id int, result interface{}) (*responseMsg, error) {
+	var r io.Reader
+	if s, ok := t.conn.(StreamReceiver); ok {
+		stream, err := s.RecvStream()
+		if err != nil {
+			return nil, err
+		}
+		r = stream
+	} else {
+		reply, err := t.recv()
+		if err != nil {
+			return nil, err
 		}
+		r = bytes.NewReader(reply)
+	}
 
-		return nil
+	in := &frameReader{r: r}
+	what := decodeReply(in, id, result)
+
+	// Skip whatever is left so the stream is positioned at the next reply
+	io.Copy(ioutil.Discard, in)
+	if in.err != nil {
+		return nil, in.err
 	}
+	return what, nil
+}
 
-	return &errors.LsmError{
-		Code:    errors.PluginBug,
-		Message: fmt.Sprintf("Unexpected response from plugin %s\n", reply)}
+// frameReader records any error reading the underlying stream, as opposed to
+// errors decoding what was read.
+type frameReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err != nil && err != io.EOF && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// decodeReply decodes a reply, its result going into result only once the ID
+// shows it is the reply to request id.  A result preceding the ID in the
+// reply is buffered until the ID has been read.
+func decodeReply(r io.Reader, id int, result interface{}) *responseMsg {
+	var what responseMsg
+	dec := json.NewDecoder(r)
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		what.decodeError = fmt.Errorf("expected object: %v", err)
+		return &what
+	}
+
+	var seenID bool
+	var matches = func() bool { return what.ID == id || what.ID == legacyID }
+	var buffered json.RawMessage
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			what.decodeError = err
+			return &what
+		}
+
+		var ignored json.RawMessage
+		switch tok {
+		case "id":
+			seenID = true
+			err = dec.Decode(&what.ID)
+		case "error":
+			err = dec.Decode(&what.Error)
+		case "result":
+			what.hasResult = true
+			if result == nil || (seenID && !matches()) {
+				err = dec.Decode(&ignored)
+			} else if !seenID {
+				err = dec.Decode(&buffered)
+			} else {
+				err = decodeResult(&what, dec.Decode(result))
+			}
+		default:
+			err = dec.Decode(&ignored)
+		}
 
+		if err != nil {
+			what.decodeError = err
+			return &what
+		}
+	}
+
+	if buffered != nil && matches() {
+		what.decodeError = decodeResult(&what, json.Unmarshal(buffered, result))
+	}
+	return &what
+}
+
+// decodeResult records a result of the wrong form in what, returning any
+// other error decoding it.
+func decodeResult(what *responseMsg, err error) error {
+	if _, ok := err.(*json.UnmarshalTypeError); ok {
+		// Rest of the value has been consumed, carry on
+		what.resultError = err
+		return nil
+	}
+	return err
 }
 
 func (t *transPort) readRequest() (*requestMsg, error) {
@@ -132,15 +486,18 @@ func (t *transPort) readRequest() (*requestMsg, error) {
 	if requestError != nil {
 		return nil, &errors.LsmError{
 			Code:    errors.TransPortCommunication,
-			Message: fmt.Sprintf("Error reading from unix domain socket %s\n", requestError)}
+			Message: fmt.Sprintf("Error reading from client %s\n", requestError),
+			Cause:   requestError}
 	}
 
 	var what requestMsg
 	if requestUnmarsal := json.Unmarshal(request, &what); requestUnmarsal != nil {
 		return nil, &errors.LsmError{
 			Code:    errors.TransPortInvalidArg,
-			Message: fmt.Sprintf("Unparsable request from client %s\n", requestUnmarsal)}
+			Message: fmt.Sprintf("Unparsable request from client %s\n", requestUnmarsal),
+			Cause:   requestUnmarsal}
 	}
+	what.size = len(request)
 	return &what, nil
 }
 
@@ -148,15 +505,16 @@ func (t *transPort) sendIt(msg string) error {
 	if sendError := t.send(msg); sendError != nil {
 		return &errors.LsmError{
 			Code:    errors.TransPortCommunication,
-			Message: fmt.Sprintf("Error writing to unix domain socket %s\n", sendError)}
+			Message: fmt.Sprintf("Error writing to client %s\n", sendError),
+			Cause:   sendError}
 	}
 	return nil
 }
 
-func (t *transPort) sendResponse(response interface{}) error {
+func (t *transPort) sendResponse(id int, response interface{}) error {
 	msg := map[string]interface{}{
 		"result": response,
-		"id":     100,
+		"id":     id,
 	}
 
 	var msgSerialized, serialError = json.Marshal(msg)
@@ -169,12 +527,12 @@ func (t *transPort) sendResponse(response interface{}) error {
 	return t.sendIt(string(msgSerialized))
 }
 
-func (t *transPort) sendError(err error) error {
-
-	// TODO Make this work for lsm errors and generic errors
+// sendError sends err to the client, errors which aren't an LsmError are
+// converted with errors.FromError.
+func (t *transPort) sendError(id int, err error) error {
 	msg := map[string]interface{}{
-		"error": err,
-		"id":    100,
+		"error": errors.FromError(err),
+		"id":    id,
 	}
 
 	var msgSerialized, serialError = json.Marshal(msg)
@@ -188,70 +546,9 @@ func (t *transPort) sendError(err error) error {
 }
 
 func (t *transPort) send(msg string) error {
-
-	var toSend = fmt.Sprintf("%010d%s", len(msg), msg)
-	if t.debug {
-		fmt.Printf("go-send: %s\n", msg)
-	}
-	return writeExact(t.uds, []byte(toSend))
+	return t.conn.Send([]byte(msg))
 }
 
 func (t *transPort) recv() ([]byte, error) {
-	hdrLenBuf := make([]byte, headerLen)
-
-	if readError := readExact(t.uds, hdrLenBuf); readError != nil {
-		return make([]byte, 0), readError
-	}
-
-	msgLen, parseError := strconv.ParseUint(string(hdrLenBuf), 10, 32)
-	if parseError != nil {
-		return make([]byte, 0), parseError
-	}
-
-	msgBuffer := make([]byte, msgLen)
-	readError := readExact(t.uds, msgBuffer)
-
-	if t.debug {
-		fmt.Printf("go-recv: %s\n", string(msgBuffer))
-	}
-
-	return msgBuffer, readError
-}
-
-func readExact(c net.Conn, buf []byte) error {
-	const tmpBufSize = 1024
-	requested := len(buf)
-	tmpBuffer := make([]byte, tmpBufSize)
-	var current int
-
-	for current < requested {
-		remain := requested - current
-		if remain > tmpBufSize {
-			remain = tmpBufSize
-		}
-
-		num, readError := c.Read(tmpBuffer[:remain])
-		if readError != nil {
-			return readError
-		}
-
-		copy(buf[current:], tmpBuffer[:num])
-		current += num
-	}
-	return nil
-}
-
-func writeExact(c net.Conn, buf []byte) error {
-	wanted := len(buf)
-	var written int
-
-	for written < wanted {
-		num, writeError := c.Write(buf[written:])
-		if writeError != nil {
-			return writeError
-		}
-		written += num
-	}
-
-	return nil
+	return t.conn.Recv()
 }
@@ -0,0 +1,511 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// JobPolling describes how a job is polled while waiting for it to finish,
+// see ClientConnection.WithJobPolling.
+type JobPolling struct {
+	// Interval is the delay before polling the job again, it doubles after
+	// every poll up to MaxInterval.  Zero means 250ms, a zero MaxInterval
+	// means no limit.
+	Interval    time.Duration
+	MaxInterval time.Duration
+
+	// Timeout limits how long waiting for a job may take, zero means waiting
+	// until the context is done.  Running out of time fails with TimeOut.
+	Timeout time.Duration
+
+	// Progress, when set, is called with the percentage complete each time
+	// it changes while waiting.
+	Progress func(jobID string, percent uint8)
+}
+
+const defaultJobInterval = 250 * time.Millisecond
+
+// DefaultJobPolling returns the polling used unless WithJobPolling says
+// otherwise: every 250ms until the context is done.
+func DefaultJobPolling() *JobPolling {
+	return &JobPolling{Interval: defaultJobInterval, MaxInterval: defaultJobInterval}
+}
+
+// WithJobPolling returns a shallow copy of the connection which waits for
+// jobs as polling describes, nil restores the default.  Like WithContext the
+// copy shares the plugin connection with c.  Job handles use the polling of
+// the connection which started them.
+func (c *ClientConnection) WithJobPolling(polling *JobPolling) *ClientConnection {
+	c2 := *c
+	c2.polling = polling
+	return &c2
+}
+
+func (c *ClientConnection) jobPolling() *JobPolling {
+	if c.polling != nil {
+		return c.polling
+	}
+	return DefaultJobPolling()
+}
+
+// JobCloseAction says what Close does with jobs which haven't been freed.
+type JobCloseAction int
+
+const (
+	// JobCloseLeave leaves the jobs on the plugin, which keeps them until
+	// lsmd is restarted.
+	JobCloseLeave JobCloseAction = iota
+
+	// JobCloseFree frees the jobs, whether or not they have finished.
+	JobCloseFree
+
+	// JobCloseWait waits for the jobs to finish, as far as the context and
+	// polling of the connection allow, freeing any still running after.
+	JobCloseWait
+)
+
+// jobTracker records the jobs handed out on a connection and not yet freed,
+// it is shared by all copies of the connection.
+type jobTracker struct {
+	mu      sync.Mutex
+	ids     map[string]struct{}
+	onClose JobCloseAction
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{ids: make(map[string]struct{})}
+}
+
+func (t *jobTracker) add(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids[id] = struct{}{}
+}
+
+func (t *jobTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.ids, id)
+}
+
+func (t *jobTracker) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids = make(map[string]struct{})
+}
+
+func (t *jobTracker) list() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rc := make([]string, 0, len(t.ids))
+	for id := range t.ids {
+		rc = append(rc, id)
+	}
+	sort.Strings(rc)
+	return rc
+}
+
+// OutstandingJobs returns the IDs of the jobs started on the connection, or
+// any copy of it, which haven't been freed yet.
+func (c *ClientConnection) OutstandingJobs() []string {
+	return c.jobs.list()
+}
+
+// JobCloseActionSet sets what Close does with outstanding jobs, the default
+// is JobCloseLeave.
+func (c *ClientConnection) JobCloseActionSet(action JobCloseAction) {
+	c.jobs.mu.Lock()
+	defer c.jobs.mu.Unlock()
+	c.jobs.onClose = action
+}
+
+func (c *ClientConnection) closeJobs() {
+	c.jobs.mu.Lock()
+	action := c.jobs.onClose
+	c.jobs.mu.Unlock()
+
+	switch action {
+	case JobCloseWait:
+		var group = JobGroup{Polling: c.polling}
+		for _, id := range c.OutstandingJobs() {
+			group.AddID(c, id, nil)
+		}
+		group.Wait(c.Context())
+		fallthrough
+	case JobCloseFree:
+		// Freeing goes ahead even if waiting stopped because ctx is done
+		freer := c.WithContext(context.Background())
+		for _, id := range c.OutstandingJobs() {
+			freer.JobFree(id)
+		}
+	}
+}
+
+// interval returns the delay before the given poll, the first one being 1.
+func (p *JobPolling) interval(poll int) time.Duration {
+	d := p.Interval
+	if d <= 0 {
+		d = defaultJobInterval
+	}
+	for i := 1; i < poll && (p.MaxInterval <= 0 || d < p.MaxInterval); i++ {
+		d *= 2
+	}
+	if p.MaxInterval > 0 && d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	return d
+}
+
+// job tracks an operation which may be running in the background on the
+// plugin.  Once the job is seen to have finished it is freed on the plugin.
+type job struct {
+	c       *ClientConnection
+	id      string
+	result  interface{}
+	mu      sync.Mutex
+	status  JobStatusType
+	percent uint8
+	err     error
+}
+
+// JobHandle is what the handles on jobs of every kind have in common.
+type JobHandle interface {
+	ID() string
+	Status() (JobStatusType, error)
+	Percent() uint8
+	Free() error
+	handle() *job
+}
+
+// Job is a handle on an operation which has no result.
+type Job struct {
+	*job
+}
+
+// VolumeJob is a handle on an operation resulting in a Volume.
+type VolumeJob struct {
+	*job
+	volume Volume
+}
+
+// FileSystemJob is a handle on an operation resulting in a FileSystem.
+type FileSystemJob struct {
+	*job
+	fs FileSystem
+}
+
+// FileSystemSnapShotJob is a handle on an operation resulting in a
+// FileSystemSnapShot.
+type FileSystemSnapShotJob struct {
+	*job
+	snapShot FileSystemSnapShot
+}
+
+// Wait waits for the operation to finish, giving up when ctx is done.
+func (j *Job) Wait(ctx context.Context) error {
+	return j.wait(ctx)
+}
+
+// Wait waits for the operation to finish and returns the volume, giving up
+// when ctx is done.
+func (j *VolumeJob) Wait(ctx context.Context) (*Volume, error) {
+	if err := j.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &j.volume, nil
+}
+
+// Wait waits for the operation to finish and returns the file system,
+// giving up when ctx is done.
+func (j *FileSystemJob) Wait(ctx context.Context) (*FileSystem, error) {
+	if err := j.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &j.fs, nil
+}
+
+// Wait waits for the operation to finish and returns the snapshot, giving up
+// when ctx is done.
+func (j *FileSystemSnapShotJob) Wait(ctx context.Context) (*FileSystemSnapShot, error) {
+	if err := j.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &j.snapShot, nil
+}
+
+// start makes a call which either completes at once or starts a job on the
+// plugin.  When withResult is true the plugin replies with a job ID and a
+// result, one of which is null, otherwise just with a job ID or null.
+func (c *ClientConnection) start(cmd string, args map[string]interface{}, withResult bool, result interface{}) (*job, error) {
+	var reply [2]json.RawMessage
+	var err error
+	if withResult {
+		err = c.invoke(cmd, args, &reply)
+	} else {
+		err = c.invoke(cmd, args, &reply[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{c: c, result: result, status: JobStatusInProgress}
+	if len(reply[0]) > 0 && string(reply[0]) != "null" {
+		if idError := json.Unmarshal(reply[0], &j.id); idError != nil {
+			return nil, &errors.LsmError{
+				Code:    errors.PluginBug,
+				Message: fmt.Sprintf("%s returned invalid job ID %s", cmd, string(reply[0])),
+				Cause:   idError}
+		}
+		c.jobs.add(j.id)
+		return j, nil
+	}
+
+	j.status = JobStatusComplete
+	j.percent = 100
+	if withResult {
+		if resultError := json.Unmarshal(reply[1], result); resultError != nil {
+			return nil, &errors.LsmError{
+				Code:    errors.PluginBug,
+				Message: fmt.Sprintf("%s returned unexpected result %s", cmd, string(reply[1])),
+				Cause:   resultError}
+		}
+	}
+	return j, nil
+}
+
+// ID returns the ID of the job on the plugin, or an empty string if the
+// operation completed without starting one.
+func (j *job) ID() string {
+	return j.id
+}
+
+// Status asks the plugin how the job is doing.  Once it has finished, with
+// JobStatusComplete or with an error, the job is freed on the plugin.
+func (j *job) Status() (JobStatusType, error) {
+	return j.poll(j.c)
+}
+
+// Percent returns how far along the job was when its status was last
+// retrieved.
+func (j *job) Percent() uint8 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.percent
+}
+
+// state returns what is known about the job without asking the plugin.
+func (j *job) state() (JobStatusType, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status, j.err
+}
+
+func (j *job) handle() *job {
+	return j
+}
+
+// Free abandons a job which hasn't finished, freeing it on the plugin.
+func (j *job) Free() error {
+	return j.free(j.c)
+}
+
+func (j *job) free(c *ClientConnection) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status != JobStatusInProgress {
+		return nil
+	}
+
+	j.status = JobStatusError
+	j.err = &errors.LsmError{
+		Code:    errors.NotFoundJob,
+		Message: fmt.Sprintf("job %s was freed before it finished", j.id)}
+	return c.JobFree(j.id)
+}
+
+// poll retrieves the status of the job with c.  Once the job has finished it
+// is freed regardless of the context of c, which may have been done by then.
+func (j *job) poll(c *ClientConnection) (JobStatusType, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status != JobStatusInProgress {
+		return j.status, j.err
+	}
+
+	status, percent, jobError, err := c.jobStatus(j.id, j.result)
+	if err != nil && transient(err) {
+		// Not hearing from the plugin tells us nothing about the job
+		return JobStatusInProgress, err
+	}
+	if err == nil {
+		err = jobError
+	}
+	freer := c.WithContext(context.Background())
+	if err != nil {
+		j.status = JobStatusError
+		j.err = err
+		freer.JobFree(j.id)
+		return j.status, j.err
+	}
+
+	j.status = status
+	j.percent = percent
+	if status == JobStatusComplete {
+		if freeError := freer.JobFree(j.id); freeError != nil {
+			j.err = &errors.LsmError{
+				Code: errors.PluginBug,
+				Message: fmt.Sprintf(
+					"We successfully waited for job %s, but got an error freeing it: %s", j.id, freeError),
+				Cause: freeError}
+		}
+	}
+	return j.status, j.err
+}
+
+// transient reports whether retrieving the status of a job failed in a way
+// which may not happen again.
+func transient(err error) bool {
+	code, _ := errors.Code(err)
+	return errors.IsTransport(err) || errors.IsRetryable(err) || code == errors.ContextExpired
+}
+
+func (j *job) wait(ctx context.Context) error {
+	p := j.c.jobPolling()
+	waitCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	// Polls are made under ctx so a stuck plugin can't hold us up past it,
+	// while Timeout is only checked between them
+	c := j.c.WithContext(ctx)
+	lastPercent := -1
+	for poll := 1; ; poll++ {
+		if err := waitCtx.Err(); err != nil {
+			return waitError(ctx, err, p, "job "+j.id)
+		}
+
+		status, err := j.poll(c)
+		if p.Progress != nil {
+			if percent := j.Percent(); int(percent) != lastPercent {
+				lastPercent = int(percent)
+				p.Progress(j.id, percent)
+			}
+		}
+		if err != nil || status != JobStatusInProgress {
+			return err
+		}
+		if sleepError := sleep(waitCtx, p.interval(poll)); sleepError != nil {
+			return waitError(ctx, sleepError, p, "job "+j.id)
+		}
+	}
+}
+
+// waitError returns the error for giving up waiting on what, either because
+// ctx is done or because the time allowed by p ran out.
+func waitError(ctx context.Context, err error, p *JobPolling, what string) error {
+	if ctx.Err() == nil {
+		return &errors.LsmError{
+			Code:    errors.TimeOut,
+			Message: fmt.Sprintf("%s still running after %v", what, p.Timeout),
+			Cause:   err}
+	}
+	return contextError("job_wait", err)
+}
+
+func (c *ClientConnection) noResultJob(cmd string, args map[string]interface{}) (*Job, error) {
+	j, err := c.start(cmd, args, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{job: j}, nil
+}
+
+func (c *ClientConnection) volumeJob(cmd string, args map[string]interface{}) (*VolumeJob, error) {
+	rc := &VolumeJob{}
+	var err error
+	if rc.job, err = c.start(cmd, args, true, &rc.volume); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (c *ClientConnection) fsJob(cmd string, args map[string]interface{}) (*FileSystemJob, error) {
+	rc := &FileSystemJob{}
+	var err error
+	if rc.job, err = c.start(cmd, args, true, &rc.fs); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (c *ClientConnection) snapShotJob(cmd string, args map[string]interface{}) (*FileSystemSnapShotJob, error) {
+	rc := &FileSystemSnapShotJob{}
+	var err error
+	if rc.job, err = c.start(cmd, args, true, &rc.snapShot); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// idOrWait gives the outcome of an operation the way the methods taking a
+// sync argument return it: the job ID when not waiting for a job, otherwise
+// nothing once the operation has completed.  As the caller never sees the ID
+// of a job it waited for, the job is freed even if waiting fails.
+func (j *job) idOrWait(sync bool) (*string, error) {
+	if len(j.id) == 0 {
+		return nil, nil
+	}
+	if sync {
+		err := j.wait(j.c.Context())
+		if err != nil {
+			j.free(j.c.WithContext(context.Background()))
+		}
+		return nil, err
+	}
+	id := j.id
+	return &id, nil
+}
+
+func jobOrWait(j *Job, err error, sync bool) (*string, error) {
+	if err != nil {
+		return nil, err
+	}
+	return j.idOrWait(sync)
+}
+
+func volumeOrJob(j *VolumeJob, err error, sync bool) (*Volume, *string, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	jobID, err := j.idOrWait(sync)
+	return ensureExclusiveVol(&j.volume, jobID, err)
+}
+
+func fsOrJob(j *FileSystemJob, err error, sync bool) (*FileSystem, *string, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	jobID, err := j.idOrWait(sync)
+	return ensureExclusiveFs(&j.fs, jobID, err)
+}
+
+func snapShotOrJob(j *FileSystemSnapShotJob, err error, sync bool) (*FileSystemSnapShot, *string, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	jobID, err := j.idOrWait(sync)
+	return ensureExclusiveSs(&j.snapShot, jobID, err)
+}
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// JobGroup waits for a number of jobs together, polling all those still
+// running at once.  The jobs may have been started on different connections.
+// The zero value is an empty group ready to use, a JobGroup must not be
+// copied after first use.
+type JobGroup struct {
+	// FailFast stops waiting as soon as a job fails, leaving any others
+	// running, instead of waiting for every job to finish.
+	FailFast bool
+
+	// Polling describes how the jobs are polled, nil for DefaultJobPolling.
+	// Its Progress is called for each job whose percentage changes.
+	Polling *JobPolling
+
+	// Progress, when set, is called with the percentage complete of the group
+	// as a whole each time it changes.  Jobs which have failed count as done.
+	Progress func(percent uint8)
+
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// JobResult is the outcome of a job waited for by a JobGroup.  The results of
+// jobs added as handles are available from the handles.
+type JobResult struct {
+	ID     string
+	Status JobStatusType
+	Err    error
+}
+
+// Add adds handles on jobs to the group.  Jobs may be added while Wait is
+// running, they are polled from its next round on.
+func (g *JobGroup) Add(jobs ...JobHandle) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, j := range jobs {
+		g.jobs = append(g.jobs, j.handle())
+	}
+}
+
+// AddID adds a job returned by a call on c to the group, its result being
+// stored in returnedResult when it completes, which may be nil.
+func (g *JobGroup) AddID(c *ClientConnection, jobID string, returnedResult interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.jobs = append(g.jobs, &job{c: c, id: jobID, result: returnedResult, status: JobStatusInProgress})
+}
+
+// Len returns the number of jobs in the group.
+func (g *JobGroup) Len() int {
+	return len(g.list())
+}
+
+// list returns the jobs added so far.
+func (g *JobGroup) list() []*job {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.jobs[:len(g.jobs):len(g.jobs)]
+}
+
+// Percent returns how far along the group as a whole was when the jobs were
+// last polled.
+func (g *JobGroup) Percent() uint8 {
+	jobs := g.list()
+	if len(jobs) == 0 {
+		return 100
+	}
+
+	var total int
+	for _, j := range jobs {
+		status, _ := j.state()
+		if status == JobStatusInProgress {
+			total += int(j.Percent())
+		} else {
+			total += 100
+		}
+	}
+	return uint8(total / len(jobs))
+}
+
+// Wait polls the jobs until every one has finished, or with FailFast until
+// one fails, giving up when ctx is done.  The results are in the order the
+// jobs were added, the error is that of the first job to fail, as in its
+// result, or the reason waiting stopped.  Jobs are freed as they finish.  If
+// the connection of a job fails waiting stops with that error, the job being
+// left InProgress.
+func (g *JobGroup) Wait(ctx context.Context) ([]JobResult, error) {
+	p := g.Polling
+	if p == nil {
+		p = DefaultJobPolling()
+	}
+
+	waitCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	lastPercents := make(map[*job]int)
+	lastOverall := -1
+
+	var failure error
+	for _, r := range g.results() {
+		if r.Err != nil {
+			failure = r.Err
+			break
+		}
+	}
+
+	for round := 1; ; round++ {
+		if err := waitCtx.Err(); err != nil {
+			return g.results(), waitError(ctx, err, p, fmt.Sprintf("%d jobs", g.running()))
+		}
+
+		// Polls are made under ctx, like job.wait
+		jobs := g.list()
+		errs := make([]error, len(jobs))
+		var wg sync.WaitGroup
+		for i, j := range jobs {
+			if status, _ := j.state(); status != JobStatusInProgress {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, j *job) {
+				defer wg.Done()
+				_, errs[i] = j.poll(j.c.WithContext(ctx))
+			}(i, j)
+		}
+		wg.Wait()
+
+		for _, j := range jobs {
+			percent := j.Percent()
+			if last, seen := lastPercents[j]; p.Progress != nil && (!seen || int(percent) != last) {
+				lastPercents[j] = int(percent)
+				p.Progress(j.id, percent)
+			}
+			if _, err := j.state(); err != nil && failure == nil {
+				failure = err
+			}
+		}
+		if overall := g.Percent(); g.Progress != nil && int(overall) != lastOverall {
+			lastOverall = int(overall)
+			g.Progress(overall)
+		}
+
+		running := g.running()
+		if running == 0 || (failure != nil && g.FailFast) {
+			return g.results(), failure
+		}
+		for i, j := range jobs {
+			// An error leaving the job running means the plugin couldn't be
+			// asked about it, which is worth trying again unless the
+			// connection has failed
+			if status, _ := j.state(); errs[i] != nil && status == JobStatusInProgress && !j.c.tp.usable() {
+				return g.results(), errs[i]
+			}
+		}
+
+		if sleepError := sleep(waitCtx, p.interval(round)); sleepError != nil {
+			return g.results(), waitError(ctx, sleepError, p, fmt.Sprintf("%d jobs", running))
+		}
+	}
+}
+
+func (g *JobGroup) running() int {
+	var rc int
+	for _, j := range g.list() {
+		if status, _ := j.state(); status == JobStatusInProgress {
+			rc++
+		}
+	}
+	return rc
+}
+
+func (g *JobGroup) results() []JobResult {
+	jobs := g.list()
+	rc := make([]JobResult, len(jobs))
+	for i, j := range jobs {
+		status, err := j.state()
+		rc[i] = JobResult{ID: j.id, Status: status, Err: err}
+	}
+	return rc
+}
@@ -21,12 +21,12 @@ func processError(errorNum int, e *C.lsm_error) error {
 		// Make sure we only free e if e is not nil
 		defer C.lsm_error_free(e)
 		return &errors.LsmError{
-			Code:    int32(C.lsm_error_number_get(e)),
+			Code:    errors.ErrorCode(C.lsm_error_number_get(e)),
 			Message: C.GoString(C.lsm_error_message_get(e))}
 	}
 	if errorNum != 0 {
 		return &errors.LsmError{
-			Code: int32(errorNum)}
+			Code: errors.ErrorCode(errorNum)}
 	}
 	return nil
 }
@@ -252,7 +252,7 @@ func LedSlotsHandleGet() (*LedSlotsHandle, error) {
 	}
 
 	return nil, &errors.LsmError{
-		Code:    int32(rc),
+		Code:    errors.ErrorCode(rc),
 		Message: fmt.Sprintf("Unexpected error: code = [%d]", rc)}
 
 }
@@ -275,7 +275,7 @@ func (l *LedSlotsHandle) SlotsGet() ([]LedSlot, error) {
 	var lsmError *C.lsm_error
 
 	var rc = C.lsm_led_slot_iterator_get(l.handle, &itr, &lsmError, 0)
-	if int32(rc) == errors.Ok {
+	if errors.ErrorCode(rc) == errors.Ok {
 		for {
 			var slot = C.lsm_led_slot_next(l.handle, itr)
 			if slot != nil {
@@ -309,7 +309,7 @@ func (l *LedSlotsHandle) StatusGet(slot *LedSlot) (lsm.DiskLedStatusBitField, er
 	var lsmError *C.lsm_error
 
 	var rc = C.lsm_led_slot_iterator_get(l.handle, &itr, &lsmError, 0)
-	if int32(rc) == errors.Ok {
+	if errors.ErrorCode(rc) == errors.Ok {
 		defer C.lsm_led_slot_iterator_free(l.handle, itr)
 		for {
 			var c_slot_handle = C.lsm_led_slot_next(l.handle, itr)
@@ -339,7 +339,7 @@ func (l *LedSlotsHandle) StatusSet(slot *LedSlot, led_status lsm.DiskLedStatusBi
 	var lsmError *C.lsm_error
 
 	var rc = C.lsm_led_slot_iterator_get(l.handle, &itr, &lsmError, 0)
-	if int32(rc) == errors.Ok {
+	if errors.ErrorCode(rc) == errors.Ok {
 		defer C.lsm_led_slot_iterator_free(l.handle, itr)
 		for {
 			var c_slot_handle = C.lsm_led_slot_next(l.handle, itr)
@@ -349,7 +349,7 @@ func (l *LedSlotsHandle) StatusSet(slot *LedSlot, led_status lsm.DiskLedStatusBi
 
 				if slot.SlotId == slot_id {
 					var status = C.lsm_led_slot_status_set(l.handle, c_slot_handle, C.uint32_t(led_status), &lsmError, 0)
-					if int32(status) == errors.Ok {
+					if errors.ErrorCode(status) == errors.Ok {
 						return nil
 					}
 					return processError(int(status), lsmError)
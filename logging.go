@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// Logger receives structured diagnostic records, args are alternating keys
+// and values.  A *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewTextLogger returns a Logger which writes one line of key=value pairs per
+// record to w.  Setting the environment variable LSM_GO_DEBUG installs one
+// writing to stderr on every new connection and plugin.
+func NewTextLogger(w io.Writer) Logger {
+	return &textLogger{l: log.New(w, "lsm: ", log.LstdFlags|log.Lmicroseconds)}
+}
+
+type textLogger struct {
+	l *log.Logger
+}
+
+func (t *textLogger) Debug(msg string, args ...interface{}) {
+	t.output("DEBUG", msg, args)
+}
+
+func (t *textLogger) Error(msg string, args ...interface{}) {
+	t.output("ERROR", msg, args)
+}
+
+func (t *textLogger) output(level string, msg string, args []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "level=%s msg=%q", level, msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+		}
+	}
+	t.l.Println(b.String())
+}
+
+func envLogger() Logger {
+	if len(os.Getenv("LSM_GO_DEBUG")) > 0 {
+		return NewTextLogger(os.Stderr)
+	}
+	return nil
+}
+
+const redacted = "<redacted>"
+
+// sensitiveParams lists for each method the parameters which must never
+// appear in a log record.
+var sensitiveParams = map[string][]string{
+	"plugin_register": {"password"},
+	"iscsi_chap_auth": {"in_password", "out_password"},
+}
+
+// redact returns params with the values of any sensitive parameters
+// replaced, params itself is left unchanged.
+func redact(method string, params map[string]interface{}) map[string]interface{} {
+	keys, ok := sensitiveParams[method]
+	if !ok {
+		return params
+	}
+
+	rc := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		rc[k] = v
+	}
+	for _, k := range keys {
+		if v, present := rc[k]; present && v != nil {
+			rc[k] = redacted
+		}
+	}
+	return rc
+}
+
+// callRecord returns the key value pairs describing a completed call.
+func callRecord(method string, id int, params map[string]interface{}, start time.Time,
+	requestSize int, err error) []interface{} {
+
+	rc := []interface{}{
+		"method", method,
+		"id", id,
+		"params", redact(method, params),
+		"duration", time.Since(start),
+		"request_size", requestSize,
+	}
+
+	if err != nil {
+		rc = append(rc, "error_code", errors.FromError(err).Code, "error", err.Error())
+	}
+	return rc
+}
@@ -0,0 +1,344 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"fmt"
+	"reflect"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// find returns the index of the only one of n items matching what is looked
+// for, or -1 if none do.  Plugins may ignore a search, so even items
+// returned by searching by ID are checked.
+func find(what string, key string, value string, n int, matches func(i int) bool) (int, error) {
+	rc := -1
+	for i := 0; i < n; i++ {
+		if !matches(i) {
+			continue
+		}
+		if rc != -1 {
+			return -1, &errors.LsmError{
+				Code:    errors.InvalidArgument,
+				Message: fmt.Sprintf("more than one %s with %s %q", what, key, value)}
+		}
+		rc = i
+	}
+	return rc, nil
+}
+
+func notFound(code errors.ErrorCode, what string, key string, value string) error {
+	return &errors.LsmError{
+		Code:    code,
+		Message: fmt.Sprintf("%s with %s %q not found", what, key, value)}
+}
+
+// lookup returns the index of the only item list returns which matches, key
+// and value saying what is looked for.  An ID must be given.
+func lookup(what string, key string, value string, code errors.ErrorCode,
+	list func() (int, error), matches func(i int) bool) (int, error) {
+
+	if key == "ID" && len(value) == 0 {
+		return -1, emptyID(what)
+	}
+	n, err := list()
+	if err != nil {
+		return -1, err
+	}
+	i, err := find(what, key, value, n, matches)
+	if err != nil {
+		return -1, err
+	}
+	if i < 0 {
+		return -1, notFound(code, what, key, value)
+	}
+	return i, nil
+}
+
+func emptyID(what string) error {
+	return &errors.LsmError{
+		Code:    errors.InvalidArgument,
+		Message: fmt.Sprintf("no %s ID given", what)}
+}
+
+// SystemByID returns the system with the given ID, failing with
+// NotFoundSystem if there is none.
+func (c *ClientConnection) SystemByID(id string) (*System, error) {
+	var systems []System
+	i, err := lookup("system", "ID", id, errors.NotFoundSystem,
+		func() (n int, err error) {
+			systems, err = c.Systems()
+			return len(systems), err
+		},
+		func(i int) bool { return systems[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &systems[i], nil
+}
+
+// SystemByName returns the system with the given name, failing with
+// NotFoundSystem if there is none and InvalidArgument if there are several.
+func (c *ClientConnection) SystemByName(name string) (*System, error) {
+	var systems []System
+	i, err := lookup("system", "name", name, errors.NotFoundSystem,
+		func() (n int, err error) {
+			systems, err = c.Systems()
+			return len(systems), err
+		},
+		func(i int) bool { return systems[i].Name == name })
+	if err != nil {
+		return nil, err
+	}
+	return &systems[i], nil
+}
+
+// PoolByID returns the pool with the given ID, failing with NotFoundPool if
+// there is none.
+func (c *ClientConnection) PoolByID(id string) (*Pool, error) {
+	var pools []Pool
+	i, err := lookup("pool", "ID", id, errors.NotFoundPool,
+		func() (n int, err error) {
+			pools, err = c.PoolsMatching(PoolFilter{ID: id})
+			return len(pools), err
+		},
+		func(i int) bool { return pools[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &pools[i], nil
+}
+
+// PoolByName returns the pool with the given name, failing with NotFoundPool
+// if there is none and InvalidArgument if there are several.
+func (c *ClientConnection) PoolByName(name string) (*Pool, error) {
+	var pools []Pool
+	i, err := lookup("pool", "name", name, errors.NotFoundPool,
+		func() (n int, err error) {
+			pools, err = c.Pools()
+			return len(pools), err
+		},
+		func(i int) bool { return pools[i].Name == name })
+	if err != nil {
+		return nil, err
+	}
+	return &pools[i], nil
+}
+
+// VolumeByID returns the volume with the given ID, failing with
+// NotFoundVolume if there is none.
+func (c *ClientConnection) VolumeByID(id string) (*Volume, error) {
+	var volumes []Volume
+	i, err := lookup("volume", "ID", id, errors.NotFoundVolume,
+		func() (n int, err error) {
+			volumes, err = c.VolumesMatching(VolumeFilter{ID: id})
+			return len(volumes), err
+		},
+		func(i int) bool { return volumes[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &volumes[i], nil
+}
+
+// VolumeByName returns the volume with the given name, failing with
+// NotFoundVolume if there is none and InvalidArgument if there are several.
+func (c *ClientConnection) VolumeByName(name string) (*Volume, error) {
+	var volumes []Volume
+	i, err := lookup("volume", "name", name, errors.NotFoundVolume,
+		func() (n int, err error) {
+			volumes, err = c.Volumes()
+			return len(volumes), err
+		},
+		func(i int) bool { return volumes[i].Name == name })
+	if err != nil {
+		return nil, err
+	}
+	return &volumes[i], nil
+}
+
+// DiskByID returns the disk with the given ID, failing with NotFoundDisk if
+// there is none.
+func (c *ClientConnection) DiskByID(id string) (*Disk, error) {
+	var disks []Disk
+	i, err := lookup("disk", "ID", id, errors.NotFoundDisk,
+		func() (n int, err error) {
+			disks, err = c.DisksMatching(DiskFilter{ID: id})
+			return len(disks), err
+		},
+		func(i int) bool { return disks[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &disks[i], nil
+}
+
+// DiskByName returns the disk with the given name, failing with NotFoundDisk
+// if there is none and InvalidArgument if there are several.
+func (c *ClientConnection) DiskByName(name string) (*Disk, error) {
+	var disks []Disk
+	i, err := lookup("disk", "name", name, errors.NotFoundDisk,
+		func() (n int, err error) {
+			disks, err = c.Disks()
+			return len(disks), err
+		},
+		func(i int) bool { return disks[i].Name == name })
+	if err != nil {
+		return nil, err
+	}
+	return &disks[i], nil
+}
+
+// FileSystemByID returns the file system with the given ID, failing with
+// NotFoundFs if there is none.
+func (c *ClientConnection) FileSystemByID(id string) (*FileSystem, error) {
+	var fileSystems []FileSystem
+	i, err := lookup("file system", "ID", id, errors.NotFoundFs,
+		func() (n int, err error) {
+			fileSystems, err = c.FileSystemsMatching(FileSystemFilter{ID: id})
+			return len(fileSystems), err
+		},
+		func(i int) bool { return fileSystems[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &fileSystems[i], nil
+}
+
+// FileSystemByName returns the file system with the given name, failing with
+// NotFoundFs if there is none and InvalidArgument if there are several.
+func (c *ClientConnection) FileSystemByName(name string) (*FileSystem, error) {
+	var fileSystems []FileSystem
+	i, err := lookup("file system", "name", name, errors.NotFoundFs,
+		func() (n int, err error) {
+			fileSystems, err = c.FileSystems()
+			return len(fileSystems), err
+		},
+		func(i int) bool { return fileSystems[i].Name == name })
+	if err != nil {
+		return nil, err
+	}
+	return &fileSystems[i], nil
+}
+
+// NfsExportByID returns the export with the given ID, failing with
+// NotFoundNfsExport if there is none.
+func (c *ClientConnection) NfsExportByID(id string) (*NfsExport, error) {
+	var exports []NfsExport
+	i, err := lookup("NFS export", "ID", id, errors.NotFoundNfsExport,
+		func() (n int, err error) {
+			exports, err = c.NfsExportsMatching(NfsExportFilter{ID: id})
+			return len(exports), err
+		},
+		func(i int) bool { return exports[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &exports[i], nil
+}
+
+// NfsExportByPath returns the export with the given export path, failing
+// with NotFoundNfsExport if there is none.
+func (c *ClientConnection) NfsExportByPath(path string) (*NfsExport, error) {
+	var exports []NfsExport
+	i, err := lookup("NFS export", "path", path, errors.NotFoundNfsExport,
+		func() (n int, err error) {
+			exports, err = c.NfsExports()
+			return len(exports), err
+		},
+		func(i int) bool { return exports[i].ExportPath == path })
+	if err != nil {
+		return nil, err
+	}
+	return &exports[i], nil
+}
+
+// AccessGroupByID returns the access group with the given ID, failing with
+// NotFoundAccessGroup if there is none.
+func (c *ClientConnection) AccessGroupByID(id string) (*AccessGroup, error) {
+	var accessGroups []AccessGroup
+	i, err := lookup("access group", "ID", id, errors.NotFoundAccessGroup,
+		func() (n int, err error) {
+			accessGroups, err = c.AccessGroupsMatching(AccessGroupFilter{ID: id})
+			return len(accessGroups), err
+		},
+		func(i int) bool { return accessGroups[i].ID == id })
+	if err != nil {
+		return nil, err
+	}
+	return &accessGroups[i], nil
+}
+
+// AccessGroupByName returns the access group with the given name, failing
+// with NotFoundAccessGroup if there is none and InvalidArgument if there are
+// several.
+func (c *ClientConnection) AccessGroupByName(name string) (*AccessGroup, error) {
+	var accessGroups []AccessGroup
+	i, err := lookup("access group", "name", name, errors.NotFoundAccessGroup,
+		func() (n int, err error) {
+			accessGroups, err = c.AccessGroups()
+			return len(accessGroups), err
+		},
+		func(i int) bool { return accessGroups[i].Name == name })
+	if err != nil {
+		return nil, err
+	}
+	return &accessGroups[i], nil
+}
+
+// Refresh retrieves obj again by its ID, replacing what it points to with
+// the current state.  obj is a non-nil *System, *Pool, *Volume, *Disk,
+// *FileSystem, *NfsExport or *AccessGroup.  If the object no longer exists
+// the NotFound error for its type is returned and obj is left as it was.
+func (c *ClientConnection) Refresh(obj interface{}) error {
+	if v := reflect.ValueOf(obj); v.Kind() == reflect.Ptr && v.IsNil() {
+		return &errors.LsmError{
+			Code:    errors.InvalidArgument,
+			Message: fmt.Sprintf("can't refresh nil %T", obj)}
+	}
+
+	var err error
+	switch o := obj.(type) {
+	case *System:
+		var fresh *System
+		if fresh, err = c.SystemByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	case *Pool:
+		var fresh *Pool
+		if fresh, err = c.PoolByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	case *Volume:
+		var fresh *Volume
+		if fresh, err = c.VolumeByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	case *Disk:
+		var fresh *Disk
+		if fresh, err = c.DiskByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	case *FileSystem:
+		var fresh *FileSystem
+		if fresh, err = c.FileSystemByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	case *NfsExport:
+		var fresh *NfsExport
+		if fresh, err = c.NfsExportByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	case *AccessGroup:
+		var fresh *AccessGroup
+		if fresh, err = c.AccessGroupByID(o.ID); err == nil {
+			*o = *fresh
+		}
+	default:
+		err = &errors.LsmError{
+			Code:    errors.InvalidArgument,
+			Message: fmt.Sprintf("can't refresh %T", obj)}
+	}
+	return err
+}
@@ -3,6 +3,7 @@
 package libstoragemgmt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -44,6 +45,38 @@ func getPlugins(path string) []string {
 	return plugins
 }
 
+// readOnlyMethods are the plugin methods which don't change any state and
+// can therefore be repeated safely.
+var readOnlyMethods = map[string]bool{
+	"plugin_info":                        true,
+	"systems":                            true,
+	"pools":                              true,
+	"volumes":                            true,
+	"disks":                              true,
+	"fs":                                 true,
+	"fs_snapshots":                       true,
+	"exports":                            true,
+	"export_auth":                        true,
+	"access_groups":                      true,
+	"target_ports":                       true,
+	"batteries":                          true,
+	"capabilities":                       true,
+	"job_status":                         true,
+	"volumes_accessible_by_access_group": true,
+	"access_groups_granted_to_volume":    true,
+	"volume_child_dependency":            true,
+	"fs_child_dependency":                true,
+	"volume_replicate_range_block_size":  true,
+	"volume_raid_info":                   true,
+	"volume_raid_create_cap_get":         true,
+	"pool_member_info":                   true,
+	"volume_cache_info":                  true,
+}
+
+func isReadOnly(method string) bool {
+	return readOnlyMethods[method]
+}
+
 func checkDaemonExists() bool {
 	var present = false
 	var udsPath = udsPath()
@@ -54,7 +87,7 @@ func checkDaemonExists() bool {
 	}
 
 	for _, pluginPath := range getPlugins(udsPath) {
-		var trans, err = newTransport(pluginPath, false)
+		var trans, err = newTransport(context.Background(), pluginPath, false)
 		if err == nil {
 			present = true
 			trans.close()
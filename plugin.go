@@ -3,10 +3,12 @@
 package libstoragemgmt
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"time"
 
 	errors "github.com/libstorage/libstoragemgmt-golang/errors"
 )
@@ -33,8 +35,9 @@ type JobStatusCb func(jobId string) (*JobInfo, error)
 // JobFreeCb callback for freeing job resources
 type JobFreeCb func(jobID string) error
 
-// PoolsCb callback for pools
-type PoolsCb func(search ...string) ([]Pool, error)
+// PoolsCb callback for pools, search is empty or a key and a value the
+// pools must match
+type PoolsCb func(search []string, flags uint64) ([]Pool, error)
 
 // PluginRegisterCb callback to register needed information
 type PluginRegisterCb func(p *PluginRegister) error
@@ -45,87 +48,88 @@ type PluginUnregisterCb func() error
 // SystemsCb callback to retrieve systems
 type SystemsCb func() ([]System, error)
 
-// DisksCb callback to retrieve disks
-type DisksCb func() ([]Disk, error)
+// DisksCb callback to retrieve disks, search is empty or a key and a value
+// the disks must match
+type DisksCb func(search []string, flags uint64) ([]Disk, error)
 
 // VolumesCb callback to retrieve volumes
-type VolumesCb func(search ...string) ([]Volume, error)
+type VolumesCb func(search []string, flags uint64) ([]Volume, error)
 
 // VolumeCreateCb callback is for creating a volume
 type VolumeCreateCb func(pool *Pool,
 	volumeName string,
 	size uint64,
-	provisioning VolumeProvisionType) (*Volume, *string, error)
+	provisioning VolumeProvisionType, flags uint64) (*Volume, *string, error)
 
 // VolumeDeleteCb callback is for deleting a volume
-type VolumeDeleteCb func(vol *Volume) (*string, error)
+type VolumeDeleteCb func(vol *Volume, flags uint64) (*string, error)
 
 // VolumeReplicateCb returns volume, job id, error.
 type VolumeReplicateCb func(optionalPool *Pool, repType VolumeReplicateType,
-	sourceVolume *Volume, name string) (*Volume, *string, error)
+	sourceVolume *Volume, name string, flags uint64) (*Volume, *string, error)
 
 // VolumeReplicateRangeCb returns job id, error
 type VolumeReplicateRangeCb func(repType VolumeReplicateType, srcVol *Volume, dstVol *Volume,
-	ranges []BlockRange) (*string, error)
+	ranges []BlockRange, flags uint64) (*string, error)
 
 // VolumeRepRangeBlkSizeCb returns blocksize, error
-type VolumeRepRangeBlkSizeCb func(system *System) (uint32, error)
+type VolumeRepRangeBlkSizeCb func(system *System, flags uint64) (uint32, error)
 
 // VolumeResizeCb returns volume, job id, error
-type VolumeResizeCb func(vol *Volume, newSizeBytes uint64) (*Volume, *string, error)
+type VolumeResizeCb func(vol *Volume, newSizeBytes uint64, flags uint64) (*Volume, *string, error)
 
 // VolumeEnableCb enables a volume
-type VolumeEnableCb func(vol *Volume) error
+type VolumeEnableCb func(vol *Volume, flags uint64) error
 
 // VolumeDisableCb enables a volume
-type VolumeDisableCb func(vol *Volume) error
+type VolumeDisableCb func(vol *Volume, flags uint64) error
 
 // VolumeMaskCb maskes a volume to the associated access group
-type VolumeMaskCb func(vol *Volume, ag *AccessGroup) error
+type VolumeMaskCb func(vol *Volume, ag *AccessGroup, flags uint64) error
 
 // VolumeUnMaskCb unmaskes a volume from the associated access group
-type VolumeUnMaskCb func(vol *Volume, ag *AccessGroup) error
+type VolumeUnMaskCb func(vol *Volume, ag *AccessGroup, flags uint64) error
 
 // VolsMaskedToAgCb returns those volumes accessible from specified access group
-type VolsMaskedToAgCb func(ag *AccessGroup) ([]Volume, error)
+type VolsMaskedToAgCb func(ag *AccessGroup, flags uint64) ([]Volume, error)
 
 // AgsGrantedToVolCb returns access group(s) which have access to specified volume
-type AgsGrantedToVolCb func(vol *Volume) ([]AccessGroup, error)
+type AgsGrantedToVolCb func(vol *Volume, flags uint64) ([]AccessGroup, error)
 
-// AccessGroupsCb returns all the access groups
-type AccessGroupsCb func() ([]AccessGroup, error)
+// AccessGroupsCb returns all the access groups, or those matching search
+type AccessGroupsCb func(search []string, flags uint64) ([]AccessGroup, error)
 
 // AccessGroupCreateCb creates an access group
-type AccessGroupCreateCb func(name string, initID string, initType InitiatorType, system *System) (*AccessGroup, error)
+type AccessGroupCreateCb func(name string, initID string, initType InitiatorType, system *System, flags uint64) (*AccessGroup, error)
 
 // AccessGroupDeleteCb deletes an access group
-type AccessGroupDeleteCb func(ag *AccessGroup) error
+type AccessGroupDeleteCb func(ag *AccessGroup, flags uint64) error
 
 // AccessGroupInitAddCb adds an initiator to an AccessGroup
 type AccessGroupInitAddCb func(ag *AccessGroup,
-	initID string, initType InitiatorType) (*AccessGroup, error)
+	initID string, initType InitiatorType, flags uint64) (*AccessGroup, error)
 
 // AccessGroupInitDeleteCb removes an initiator from an AccessGroup
 type AccessGroupInitDeleteCb func(ag *AccessGroup,
-	initID string, initType InitiatorType) (*AccessGroup, error)
+	initID string, initType InitiatorType, flags uint64) (*AccessGroup, error)
 
 // IscsiChapAuthSetCb iSCSI CHAP authentication
-type IscsiChapAuthSetCb func(initID string, inUser *string, inPassword *string, outUser *string, outPassword *string) error
+type IscsiChapAuthSetCb func(initID string, inUser *string, inPassword *string, outUser *string, outPassword *string, flags uint64) error
 
 // VolHasChildDepCb returns boolean on if specified volume has child dependencies
-type VolHasChildDepCb func(vol *Volume) (bool, error)
+type VolHasChildDepCb func(vol *Volume, flags uint64) (bool, error)
 
 // VolChildDepRmCb removes any child dependencies
-type VolChildDepRmCb func(vol *Volume) (*string, error)
+type VolChildDepRmCb func(vol *Volume, flags uint64) (*string, error)
 
-// TargetPortsCb returns target ports
-type TargetPortsCb func() ([]TargetPort, error)
+// TargetPortsCb returns target ports, all of them or those matching search
+type TargetPortsCb func(search []string, flags uint64) ([]TargetPort, error)
 
 // VolIdentLedOnCb turn identification led on
-type VolIdentLedOnCb func(volume *Volume) error
+type VolIdentLedOnCb func(volume *Volume, flags uint64) error
 
 // VolIdentLedOffCb turn identification led off
-type VolIdentLedOffCb func(volume *Volume) error
+type VolIdentLedOffCb func(volume *Volume, flags uint64) error
 
 // ManagementOps are the callbacks that plugins must implement
 type ManagementOps struct {
@@ -140,7 +144,12 @@ type ManagementOps struct {
 	PluginUnregister PluginUnregisterCb
 }
 
-// SanOps are storage area network callbacks
+// SanOps are storage area network callbacks, the flags they are passed are
+// those the client set with ClientConnection.WithFlags.  Flags are always the
+// last argument, callbacks which search take the search terms as a slice
+// before them.  This changed the signature of every SanOps, FsOps and NfsOps
+// callback, and of ManagementOps.Pools and HbaRaidOps.Batteries, plugins
+// written for earlier versions need updating.
 type SanOps struct {
 	Volumes               VolumesCb
 	VolumeCreate          VolumeCreateCb
@@ -170,49 +179,49 @@ type SanOps struct {
 }
 
 // FsCb callback returns filesystems
-type FsCb func(search ...string) ([]FileSystem, error)
+type FsCb func(search []string, flags uint64) ([]FileSystem, error)
 
 // FsCreateCb callback creates a file system
-type FsCreateCb func(pool *Pool, name string, size uint64) (*FileSystem, *string, error)
+type FsCreateCb func(pool *Pool, name string, size uint64, flags uint64) (*FileSystem, *string, error)
 
 // FsDeleteCb callback deletes a file system
-type FsDeleteCb func(fs *FileSystem) (*string, error)
+type FsDeleteCb func(fs *FileSystem, flags uint64) (*string, error)
 
 // FsResizeCb callback resizes a file system
-type FsResizeCb func(fs *FileSystem, newSizeBytes uint64) (*FileSystem, *string, error)
+type FsResizeCb func(fs *FileSystem, newSizeBytes uint64, flags uint64) (*FileSystem, *string, error)
 
 // FsCloneCb callback clones a file system
 type FsCloneCb func(srcFs *FileSystem,
 	destName string,
-	optionalSnapShot *FileSystemSnapShot) (*FileSystem, *string, error)
+	optionalSnapShot *FileSystemSnapShot, flags uint64) (*FileSystem, *string, error)
 
 // FsFileCloneCb callback snap shots files on a file system
 type FsFileCloneCb func(fs *FileSystem,
 	srcFileName string,
 	dstFileName string,
-	optionalSnapShot *FileSystemSnapShot) (*string, error)
+	optionalSnapShot *FileSystemSnapShot, flags uint64) (*string, error)
 
 // FsSnapShotCreateCb callback creates a snapshot
-type FsSnapShotCreateCb func(s *FileSystem, name string) (*FileSystemSnapShot, *string, error)
+type FsSnapShotCreateCb func(s *FileSystem, name string, flags uint64) (*FileSystemSnapShot, *string, error)
 
 // FsSnapShotDeleteCb callback deletes a snapshot
-type FsSnapShotDeleteCb func(fs *FileSystem, snapShot *FileSystemSnapShot) (*string, error)
+type FsSnapShotDeleteCb func(fs *FileSystem, snapShot *FileSystemSnapShot, flags uint64) (*string, error)
 
 // FsSnapShotsCb callback returns array of file system snapshots
-type FsSnapShotsCb func(fs *FileSystem) ([]FileSystemSnapShot, error)
+type FsSnapShotsCb func(fs *FileSystem, flags uint64) ([]FileSystemSnapShot, error)
 
 // FsSnapShotRestoreCb callback restores a file system from a snapshot
 type FsSnapShotRestoreCb func(
 	fs *FileSystem, snapShot *FileSystemSnapShot, allFiles bool,
-	files []string, restoreFiles []string) (*string, error)
+	files []string, restoreFiles []string, flags uint64) (*string, error)
 
 // FsHasChildDepCb callback returns boolean indicating if filesystem has child dependencies
-type FsHasChildDepCb func(fs *FileSystem, files []string) (bool, error)
+type FsHasChildDepCb func(fs *FileSystem, files []string, flags uint64) (bool, error)
 
 // FsChildDepRmCb callback removes child filesystem dependecies by replicating as needed
-type FsChildDepRmCb func(fs *FileSystem, files []string) (*string, error)
+type FsChildDepRmCb func(fs *FileSystem, files []string, flags uint64) (*string, error)
 
-// FsOps file system callbacks
+// FsOps file system callbacks, passed the flags of the request like SanOps
 type FsOps struct {
 	FileSystems       FsCb
 	FsCreate          FsCreateCb
@@ -229,19 +238,19 @@ type FsOps struct {
 }
 
 // ExportsCb returns all exported file systems
-type ExportsCb func(search ...string) ([]NfsExport, error)
+type ExportsCb func(search []string, flags uint64) ([]NfsExport, error)
 
 // ExportAuthTypesCb returns array of strings that state what authentication types are supported
-type ExportAuthTypesCb func() ([]string, error)
+type ExportAuthTypesCb func(flags uint64) ([]string, error)
 
 // FsExportCb exports a file system over NFS
 type FsExportCb func(fs *FileSystem, exportPath *string,
-	access *NfsAccess, authType *string, options *string) (*NfsExport, error)
+	access *NfsAccess, authType *string, options *string, flags uint64) (*NfsExport, error)
 
 // FsUnExportCb removes a NFS export
-type FsUnExportCb func(export *NfsExport) error
+type FsUnExportCb func(export *NfsExport, flags uint64) error
 
-// NfsOps orientated callbacks
+// NfsOps orientated callbacks, passed the flags of the request like SanOps
 type NfsOps struct {
 	Exports         ExportsCb
 	ExportAuthTypes ExportAuthTypesCb
@@ -262,8 +271,9 @@ type VolRaidCreateCapGetCb func(system *System) (*SupportedRaidCapability, error
 type VolRaidCreateCb func(name string,
 	raidType RaidType, disks []Disk, stripSize uint32) (*Volume, error)
 
-// BatteriesCb returns array of batteries
-type BatteriesCb func() ([]Battery, error)
+// BatteriesCb returns array of batteries, search is empty or a key and a
+// value the batteries must match
+type BatteriesCb func(search []string, flags uint64) ([]Battery, error)
 
 // HbaRaidOps callbacks for HBA raid
 type HbaRaidOps struct {
@@ -312,7 +322,7 @@ type handler func(p *Plugin, params *requestMsg) (interface{}, error)
 
 // Plugin represents plugin
 type Plugin struct {
-	tp        transPort
+	tp        *transPort
 	cb        *PluginCallBacks
 	callTable map[string]handler
 	desc      string
@@ -353,19 +363,26 @@ func PluginInit(callbacks *PluginCallBacks, cmdLineArgs []string, desc string, v
 			return nil, err
 		}
 
-		tp := transPort{uds: s, debug: false}
-		return &Plugin{tp: tp, cb: callbacks, callTable: buildTable(callbacks), desc: desc, ver: ver}, nil
+		return PluginWithTransport(callbacks, NewConnTransport(s), desc, ver), nil
 	}
 	return nil, &errors.LsmError{
 		Code:    errors.LibBug,
 		Message: fmt.Sprintf("Plugin called with invalid args: %s\n", cmdLineArgs)}
 }
 
-func noSupport(tp *transPort, method string) {
-	tp.sendError(&errors.LsmError{
+// PluginWithTransport creates a plugin which serves the client at the other
+// end of the supplied transport, eg. one end of NewPipeTransport.
+func PluginWithTransport(callbacks *PluginCallBacks, transport Transport, desc string, ver string) *Plugin {
+	return &Plugin{tp: newTransPort(transport), cb: callbacks, callTable: buildTable(callbacks), desc: desc, ver: ver}
+}
+
+func noSupport(tp *transPort, request *requestMsg) error {
+	err := &errors.LsmError{
 		Code: errors.NoSupport,
 		Message: fmt.Sprintf(
-			"method %s not supported", method)})
+			"method %s not supported", request.Method)}
+	tp.sendError(request.ID, err)
+	return err
 }
 
 // Run the plugin, looping processing requests and sending responses.
@@ -376,35 +393,65 @@ func (p *Plugin) Run() {
 			if lsmError, ok := err.(*errors.LsmError); ok == true {
 
 				if lsmError.Code != errors.TransPortCommunication {
-					p.tp.sendError(lsmError)
-					//fmt.Printf("Returned error %+v\n", lsmError)
+					// We couldn't parse the request, so we don't know its ID
+					p.tp.sendError(legacyID, lsmError)
+					p.logError("unparsable request", "error_code", lsmError.Code, "error", lsmError.Error())
 					continue
 				} else {
-					fmt.Printf("Communication error: exiting! %s\n", lsmError)
+					p.logError("communication error, exiting", "error", lsmError.Error())
 				}
 				return
 			}
-			fmt.Printf("Unexpected error, exiting! %s\n", err)
+			p.logError("unexpected error, exiting", "error", err.Error())
 			return
 		}
 
+		start := time.Now()
 		var response interface{}
-		if f, ok := p.callTable[request.Method]; ok == true && f != nil {
-			//fmt.Printf("Executing %s(%s)\n", request.Method, string(request.Params))
+		f, handled := p.callTable[request.Method]
+		if handled && f != nil {
 			response, err = f(p, request)
 			if err != nil {
-				p.tp.sendError(err)
+				p.tp.sendError(request.ID, err)
 			} else {
-				p.tp.sendResponse(response)
-			}
-
-			// Need to shut down the connection.
-			if request.Method == "plugin_unregister" {
-				p.tp.close()
-				return
+				p.tp.sendResponse(request.ID, response)
 			}
 		} else {
-			noSupport(&p.tp, request.Method)
+			err = noSupport(p.tp, request)
+		}
+		p.logRequest(request, start, err)
+
+		// Need to shut down the connection.
+		if request.Method == "plugin_unregister" && handled && f != nil {
+			p.tp.close()
+			return
 		}
 	}
 }
+
+// LoggerSet directs the diagnostics of the plugin to l, nil disables them.
+func (p *Plugin) LoggerSet(l Logger) {
+	p.tp.loggerSet(l)
+}
+
+// MaxFrameSizeSet limits the size of a request from the client, the default
+// is DefaultMaxFrameSize.
+func (p *Plugin) MaxFrameSizeSet(size int) {
+	p.tp.maxFrameSizeSet(size)
+}
+
+func (p *Plugin) logError(msg string, args ...interface{}) {
+	if p.tp.log != nil {
+		p.tp.log.Error(msg, args...)
+	}
+}
+
+func (p *Plugin) logRequest(request *requestMsg, start time.Time, err error) {
+	if p.tp.log == nil {
+		return
+	}
+
+	var params map[string]interface{}
+	json.Unmarshal(request.Params, &params)
+	p.tp.log.Debug("request", callRecord(request.Method, request.ID, params, start, request.size, err)...)
+}
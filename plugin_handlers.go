@@ -55,7 +55,20 @@ func handleSystems(p *Plugin, msg *requestMsg) (interface{}, error) {
 }
 
 func handleDisks(p *Plugin, msg *requestMsg) (interface{}, error) {
-	return p.cb.San.Disks()
+	var s search
+	if uE := json.Unmarshal(msg.Params, &s); uE != nil {
+		return nil, invalidArgs(msg.Method, uE)
+	}
+
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
+	}
+	return p.cb.San.Disks(terms, s.Flags)
+}
+
+type flagsArg struct {
+	Flags uint64 `json:"flags"`
 }
 
 type search struct {
@@ -64,17 +77,29 @@ type search struct {
 	Flags uint64 `json:"flags"`
 }
 
+// terms returns the search as passed to the callbacks, after checking the
+// key is one the method supports.
+func (s *search) terms(method string) ([]string, error) {
+	if len(s.Key) == 0 {
+		return nil, nil
+	}
+	if err := checkSearchKey(method, s.Key); err != nil {
+		return nil, err
+	}
+	return []string{s.Key, s.Value}, nil
+}
+
 func handlePools(p *Plugin, msg *requestMsg) (interface{}, error) {
 	var s search
 	if uE := json.Unmarshal(msg.Params, &s); uE != nil {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	if len(s.Key) > 0 {
-		return p.cb.Mgmt.Pools(s.Key, s.Value)
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
 	}
-
-	return p.cb.Mgmt.Pools()
+	return p.cb.Mgmt.Pools(terms, s.Flags)
 }
 
 func handleVolumes(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -83,11 +108,11 @@ func handleVolumes(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	if len(s.Key) > 0 {
-		return p.cb.San.Volumes(s.Key, s.Value)
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
 	}
-
-	return p.cb.San.Volumes()
+	return p.cb.San.Volumes(terms, s.Flags)
 }
 
 type capArgs struct {
@@ -99,6 +124,7 @@ func handleCapabilities(p *Plugin, msg *requestMsg) (interface{}, error) {
 	if uE := json.Unmarshal(msg.Params, &args); uE != nil {
 		return nil, invalidArgs(msg.Method, uE)
 	}
+
 	return p.cb.Mgmt.Capabilities(&args.Sys)
 }
 
@@ -166,7 +192,7 @@ func handleVolumeCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	volume, jobID, error := p.cb.San.VolumeCreate(args.Pool, args.Name, args.SizeBytes, args.Provisioning)
+	volume, jobID, error := p.cb.San.VolumeCreate(args.Pool, args.Name, args.SizeBytes, args.Provisioning, args.Flags)
 	return exclusiveOr(volume, jobID, error)
 }
 
@@ -184,7 +210,7 @@ func handleVolumeReplicate(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	volume, jobID, error := p.cb.San.VolumeReplicate(args.Pool, args.RepType, &args.SrcVol, args.Name)
+	volume, jobID, error := p.cb.San.VolumeReplicate(args.Pool, args.RepType, &args.SrcVol, args.Name, args.Flags)
 	return exclusiveOr(volume, jobID, error)
 }
 
@@ -202,7 +228,7 @@ func handleVolumeReplicateRange(p *Plugin, msg *requestMsg) (interface{}, error)
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.VolumeReplicateRange(a.RepType, &a.SrcVol, &a.DstVol, a.Ranges)
+	return p.cb.San.VolumeReplicateRange(a.RepType, &a.SrcVol, &a.DstVol, a.Ranges, a.Flags)
 }
 
 func handleVolRepRangeBlockSize(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -215,7 +241,8 @@ func handleVolRepRangeBlockSize(p *Plugin, msg *requestMsg) (interface{}, error)
 	if uE := json.Unmarshal(msg.Params, &a); uE != nil {
 		return nil, invalidArgs(msg.Method, uE)
 	}
-	return p.cb.San.VolumeRepRangeBlkSize(a.System)
+
+	return p.cb.San.VolumeRepRangeBlkSize(a.System, a.Flags)
 }
 
 func handleVolumeResize(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -230,9 +257,7 @@ func handleVolumeResize(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	fmt.Printf("args = %+v\n", a)
-
-	volume, jobID, error := p.cb.San.VolumeResize(a.Volume, a.Size)
+	volume, jobID, error := p.cb.San.VolumeResize(a.Volume, a.Size, a.Flags)
 	return exclusiveOr(volume, jobID, error)
 }
 
@@ -247,7 +272,7 @@ func handleVolumeEnable(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.San.VolumeEnable(args.Volume)
+	return nil, p.cb.San.VolumeEnable(args.Volume, args.Flags)
 }
 
 func handleVolumeDisable(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -256,7 +281,7 @@ func handleVolumeDisable(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.San.VolumeDisable(args.Volume)
+	return nil, p.cb.San.VolumeDisable(args.Volume, args.Flags)
 }
 
 func handleVolumeDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -270,7 +295,7 @@ func handleVolumeDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.VolumeDelete(args.Volume)
+	return p.cb.San.VolumeDelete(args.Volume, args.Flags)
 }
 
 type maskArgs struct {
@@ -285,7 +310,7 @@ func handleVolumeMask(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.San.VolumeMask(args.Vol, args.Ag)
+	return nil, p.cb.San.VolumeMask(args.Vol, args.Ag, args.Flags)
 }
 
 func handleVolumeUnMask(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -294,7 +319,7 @@ func handleVolumeUnMask(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.San.VolumeUnMask(args.Vol, args.Ag)
+	return nil, p.cb.San.VolumeUnMask(args.Vol, args.Ag, args.Flags)
 }
 
 func handleVolsMaskedToAg(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -308,11 +333,20 @@ func handleVolsMaskedToAg(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.VolsMaskedToAg(args.Ag)
+	return p.cb.San.VolsMaskedToAg(args.Ag, args.Flags)
 }
 
 func handleAccessGroups(p *Plugin, msg *requestMsg) (interface{}, error) {
-	return p.cb.San.AccessGroups()
+	var s search
+	if uE := json.Unmarshal(msg.Params, &s); uE != nil {
+		return nil, invalidArgs(msg.Method, uE)
+	}
+
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
+	}
+	return p.cb.San.AccessGroups(terms, s.Flags)
 }
 
 func handleAccessGroupCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -329,7 +363,7 @@ func handleAccessGroupCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.AccessGroupCreate(args.Name, args.InitID, args.InitType, args.System)
+	return p.cb.San.AccessGroupCreate(args.Name, args.InitID, args.InitType, args.System, args.Flags)
 }
 
 func handleAccessGroupDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -343,7 +377,7 @@ func handleAccessGroupDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.San.AccessGroupDelete(args.Ag)
+	return nil, p.cb.San.AccessGroupDelete(args.Ag, args.Flags)
 }
 
 type accessGroupInitArgs struct {
@@ -360,7 +394,7 @@ func handleAccessGroupInitAdd(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.AccessGroupInitAdd(args.Ag, args.ID, args.InitType)
+	return p.cb.San.AccessGroupInitAdd(args.Ag, args.ID, args.InitType, args.Flags)
 }
 
 func handleAccessGroupInitDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -369,7 +403,7 @@ func handleAccessGroupInitDelete(p *Plugin, msg *requestMsg) (interface{}, error
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.AccessGroupInitDelete(args.Ag, args.ID, args.InitType)
+	return p.cb.San.AccessGroupInitDelete(args.Ag, args.ID, args.InitType, args.Flags)
 }
 
 func handleAgsGrantedToVol(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -383,7 +417,7 @@ func handleAgsGrantedToVol(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.AgsGrantedToVol(args.Vol)
+	return p.cb.San.AgsGrantedToVol(args.Vol, args.Flags)
 }
 
 func handleIscsiChapAuthSet(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -401,7 +435,7 @@ func handleIscsiChapAuthSet(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.San.IscsiChapAuthSet(args.InitID, args.InUser, args.InPassword, args.OutUser, args.OutPassword)
+	return nil, p.cb.San.IscsiChapAuthSet(args.InitID, args.InUser, args.InPassword, args.OutUser, args.OutPassword, args.Flags)
 }
 
 type volumeArg struct {
@@ -415,7 +449,7 @@ func handleVolHasChildDep(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.VolHasChildDep(args.Vol)
+	return p.cb.San.VolHasChildDep(args.Vol, args.Flags)
 }
 
 func handleVolChildDepRm(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -424,11 +458,20 @@ func handleVolChildDepRm(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.San.VolChildDepRm(args.Vol)
+	return p.cb.San.VolChildDepRm(args.Vol, args.Flags)
 }
 
 func handleTargetPorts(p *Plugin, msg *requestMsg) (interface{}, error) {
-	return p.cb.San.TargetPorts()
+	var s search
+	if uE := json.Unmarshal(msg.Params, &s); uE != nil {
+		return nil, invalidArgs(msg.Method, uE)
+	}
+
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
+	}
+	return p.cb.San.TargetPorts(terms, s.Flags)
 }
 
 func handleVolIdentLedOn(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -436,7 +479,7 @@ func handleVolIdentLedOn(p *Plugin, msg *requestMsg) (interface{}, error) {
 	if uE := json.Unmarshal(msg.Params, &args); uE != nil {
 		return nil, invalidArgs(msg.Method, uE)
 	}
-	return nil, p.cb.San.VolIdentLedOn(args.Vol)
+	return nil, p.cb.San.VolIdentLedOn(args.Vol, args.Flags)
 }
 
 func handleVolIdentLedOff(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -444,7 +487,7 @@ func handleVolIdentLedOff(p *Plugin, msg *requestMsg) (interface{}, error) {
 	if uE := json.Unmarshal(msg.Params, &args); uE != nil {
 		return nil, invalidArgs(msg.Method, uE)
 	}
-	return nil, p.cb.San.VolIdentLedOff(args.Vol)
+	return nil, p.cb.San.VolIdentLedOff(args.Vol, args.Flags)
 }
 
 func handleFs(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -453,10 +496,11 @@ func handleFs(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	if len(s.Key) > 0 {
-		return p.cb.File.FileSystems(s.Key, s.Value)
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
 	}
-	return p.cb.File.FileSystems()
+	return p.cb.File.FileSystems(terms, s.Flags)
 }
 
 func handleFsCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -472,7 +516,7 @@ func handleFsCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	fs, jobID, error := p.cb.File.FsCreate(args.Pool, args.Name, args.SizeBytes)
+	fs, jobID, error := p.cb.File.FsCreate(args.Pool, args.Name, args.SizeBytes, args.Flags)
 	return exclusiveOr(fs, jobID, error)
 }
 
@@ -486,7 +530,8 @@ func handleFsDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
 	if uE := json.Unmarshal(msg.Params, &args); uE != nil {
 		return nil, invalidArgs(msg.Method, uE)
 	}
-	return p.cb.File.FsDelete(args.Fs)
+
+	return p.cb.File.FsDelete(args.Fs, args.Flags)
 }
 
 func handleFsResize(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -501,7 +546,7 @@ func handleFsResize(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	fs, job, err := p.cb.File.FsResize(args.Fs, args.Size)
+	fs, job, err := p.cb.File.FsResize(args.Fs, args.Size, args.Flags)
 	return exclusiveOr(fs, job, err)
 
 }
@@ -519,7 +564,7 @@ func handleFsClone(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	fs, job, err := p.cb.File.FsClone(args.Fs, args.Name, args.Ss)
+	fs, job, err := p.cb.File.FsClone(args.Fs, args.Name, args.Ss, args.Flags)
 	return exclusiveOr(fs, job, err)
 
 }
@@ -538,7 +583,7 @@ func handleFsFileClone(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.File.FsFileClone(args.Fs, args.Src, args.Dst, args.Ss)
+	return p.cb.File.FsFileClone(args.Fs, args.Src, args.Dst, args.Ss, args.Flags)
 }
 
 func handleFsSnapShotCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -553,7 +598,7 @@ func handleFsSnapShotCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	fs, job, err := p.cb.File.FsSnapShotCreate(args.Fs, args.Name)
+	fs, job, err := p.cb.File.FsSnapShotCreate(args.Fs, args.Name, args.Flags)
 	return exclusiveOr(fs, job, err)
 }
 
@@ -569,7 +614,7 @@ func handleFsSnapShotDelete(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.File.FsSnapShotDelete(args.Fs, args.Ss)
+	return p.cb.File.FsSnapShotDelete(args.Fs, args.Ss, args.Flags)
 }
 
 func handleFsSnapShots(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -584,7 +629,7 @@ func handleFsSnapShots(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.File.FsSnapShots(args.Fs)
+	return p.cb.File.FsSnapShots(args.Fs, args.Flags)
 }
 
 func handleFsSnapShotRestore(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -603,7 +648,7 @@ func handleFsSnapShotRestore(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.File.FsSnapShotRestore(args.Fs, args.Ss, args.All, args.Files, args.RestoreFiles)
+	return p.cb.File.FsSnapShotRestore(args.Fs, args.Ss, args.All, args.Files, args.RestoreFiles, args.Flags)
 }
 
 type fsHasChildDepsArgs struct {
@@ -618,7 +663,7 @@ func handleFsHasChildDep(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.File.FsHasChildDep(args.Fs, args.Files)
+	return p.cb.File.FsHasChildDep(args.Fs, args.Files, args.Flags)
 }
 
 func handleFsChildDepRm(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -627,7 +672,7 @@ func handleFsChildDepRm(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return p.cb.File.FsChildDepRm(args.Fs, args.Files)
+	return p.cb.File.FsChildDepRm(args.Fs, args.Files, args.Flags)
 }
 
 func handleNfsExports(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -636,10 +681,11 @@ func handleNfsExports(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	if len(s.Key) > 0 {
-		return p.cb.Nfs.Exports(s.Key, s.Value)
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
 	}
-	return p.cb.Nfs.Exports()
+	return p.cb.Nfs.Exports(terms, s.Flags)
 }
 
 func handleExportFs(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -662,7 +708,7 @@ func handleExportFs(p *Plugin, msg *requestMsg) (interface{}, error) {
 	}
 
 	// This seems like a blunder in the original API or maybe the preferred way to do it.
-	fs, err := p.cb.File.FileSystems("id", *a.FsID)
+	fs, err := p.cb.File.FileSystems([]string{"id", *a.FsID}, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -673,7 +719,7 @@ func handleExportFs(p *Plugin, msg *requestMsg) (interface{}, error) {
 	}
 
 	access := NfsAccess{Root: a.Root, Rw: a.Rw, Ro: a.Ro, AnonUID: a.AnonUID, AnonGID: a.AnonGID}
-	return p.cb.Nfs.FsExport(&fs[0], a.Path, &access, a.AuthType, a.Options)
+	return p.cb.Nfs.FsExport(&fs[0], a.Path, &access, a.AuthType, a.Options, a.Flags)
 }
 
 func handleFsUnexport(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -687,11 +733,16 @@ func handleFsUnexport(p *Plugin, msg *requestMsg) (interface{}, error) {
 		return nil, invalidArgs(msg.Method, uE)
 	}
 
-	return nil, p.cb.Nfs.FsUnExport(args.Export)
+	return nil, p.cb.Nfs.FsUnExport(args.Export, args.Flags)
 }
 
 func handleExportAuthTypes(p *Plugin, msg *requestMsg) (interface{}, error) {
-	return p.cb.Nfs.ExportAuthTypes()
+	var args flagsArg
+	if uE := json.Unmarshal(msg.Params, &args); uE != nil {
+		return nil, invalidArgs(msg.Method, uE)
+	}
+
+	return p.cb.Nfs.ExportAuthTypes(args.Flags)
 }
 
 func handleVolRaidCreate(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -782,7 +833,16 @@ func handleVolRaidInfo(p *Plugin, msg *requestMsg) (interface{}, error) {
 }
 
 func handleBatteries(p *Plugin, msg *requestMsg) (interface{}, error) {
-	return p.cb.Hba.Batteries()
+	var s search
+	if uE := json.Unmarshal(msg.Params, &s); uE != nil {
+		return nil, invalidArgs(msg.Method, uE)
+	}
+
+	terms, err := s.terms(msg.Method)
+	if err != nil {
+		return nil, err
+	}
+	return p.cb.Hba.Batteries(terms, s.Flags)
 }
 
 func handleSystemReadCachePctSet(p *Plugin, msg *requestMsg) (interface{}, error) {
@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+const (
+	// RecordSend marks a message sent by the client.
+	RecordSend = "send"
+
+	// RecordRecv marks a message received from the plugin.
+	RecordRecv = "recv"
+)
+
+// RecordEntry is one line of a recording made by NewRecorder.
+type RecordEntry struct {
+	Session   string    `json:"session"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Message   string    `json:"msg"`
+}
+
+var sessions uint64
+
+// recorder writes every message passing through a transport to w as JSON
+// lines.
+type recorder struct {
+	t       Transport
+	session string
+	mu      sync.Mutex
+	w       io.Writer
+	closer  io.Closer
+}
+
+// NewRecorder returns a Transport which passes messages to and from t,
+// writing each of them to w as a RecordEntry on a line of its own.  Passwords
+// are redacted before they are written.  The recording can be played back to
+// a client with NewReplayTransport.  Replies t hands out as streams are
+// passed on as streams, a copy being kept for the recording as they are read.
+// Setting the environment variable LSM_GO_RECORD to a file name records every
+// connection to that file.
+func NewRecorder(t Transport, w io.Writer) Transport {
+	return &recorder{t: t, w: w,
+		session: fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint64(&sessions, 1))}
+}
+
+func envRecorder(t Transport) Transport {
+	path := os.Getenv("LSM_GO_RECORD")
+	if len(path) == 0 {
+		return t
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return t
+	}
+	r := NewRecorder(t, f).(*recorder)
+	r.closer = f
+	return r
+}
+
+func (r *recorder) record(direction string, msg []byte) {
+	if direction == RecordSend {
+		msg = redactRequest(msg)
+	}
+
+	line, err := json.Marshal(&RecordEntry{
+		Session: r.session, Time: time.Now(), Direction: direction, Message: string(msg)})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(append(line, '\n'))
+}
+
+// redactRequest returns msg with any passwords removed from its parameters.
+func redactRequest(msg []byte) []byte {
+	var request struct {
+		ID     int                    `json:"id"`
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}
+	if json.Unmarshal(msg, &request) != nil {
+		return msg
+	}
+	if _, ok := sensitiveParams[request.Method]; !ok {
+		return msg
+	}
+
+	request.Params = redact(request.Method, request.Params)
+	rc, err := json.Marshal(&request)
+	if err != nil {
+		return msg
+	}
+	return rc
+}
+
+func (r *recorder) Send(msg []byte) error {
+	r.record(RecordSend, msg)
+	return r.t.Send(msg)
+}
+
+func (r *recorder) Recv() ([]byte, error) {
+	msg, err := r.t.Recv()
+	if err == nil {
+		r.record(RecordRecv, msg)
+	}
+	return msg, err
+}
+
+func (r *recorder) RecvStream() (io.Reader, error) {
+	s, ok := r.t.(StreamReceiver)
+	if !ok {
+		msg, err := r.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(msg), nil
+	}
+
+	stream, err := s.RecvStream()
+	if err != nil {
+		return nil, err
+	}
+	return &recordedStream{r: r, stream: stream}, nil
+}
+
+// recordedStream records a message received as a stream once it has been
+// read in full.
+type recordedStream struct {
+	r      *recorder
+	stream io.Reader
+	msg    bytes.Buffer
+	done   bool
+}
+
+func (s *recordedStream) Read(p []byte) (int, error) {
+	n, err := s.stream.Read(p)
+	s.msg.Write(p[:n])
+	if err == io.EOF && !s.done {
+		s.done = true
+		s.r.record(RecordRecv, s.msg.Bytes())
+	}
+	return n, err
+}
+
+func (r *recorder) MaxFrameSizeSet(size int) {
+	if l, ok := r.t.(FrameSizeLimiter); ok {
+		l.MaxFrameSizeSet(size)
+	}
+}
+
+func (r *recorder) SetDeadline(t time.Time) error {
+	return r.t.SetDeadline(t)
+}
+
+func (r *recorder) Close() error {
+	err := r.t.Close()
+	if r.closer != nil {
+		r.closer.Close()
+	}
+	return err
+}
+
+// replay serves the replies of a recording.
+type replay struct {
+	mu      sync.Mutex
+	entries []RecordEntry
+	pending []string
+	closed  bool
+}
+
+// NewReplayTransport returns a Transport which plays back the first session
+// of a recording made with NewRecorder, standing in for the plugin.  Each
+// message sent must call the same method as the next one recorded, the
+// replies recorded after it are then received in turn with their ID matched
+// to the request.  Use it with ClientWithTransport.
+func NewReplayTransport(r io.Reader) (Transport, error) {
+	var entries []RecordEntry
+	var session string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), DefaultMaxFrameSize*2)
+	for scanner.Scan() {
+		var entry RecordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, &errors.LsmError{
+				Code:    errors.InvalidArgument,
+				Message: fmt.Sprintf("invalid recording entry %d: %s", len(entries)+1, err)}
+		}
+		if len(session) == 0 {
+			session = entry.Session
+		}
+		if entry.Session == session {
+			entries = append(entries, entry)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, &errors.LsmError{
+			Code:    errors.InvalidArgument,
+			Message: fmt.Sprintf("error reading recording: %s", err)}
+	}
+	return &replay{entries: entries}, nil
+}
+
+func (p *replay) Send(msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return io.ErrClosedPipe
+	}
+
+	var request requestMsg
+	if err := json.Unmarshal(msg, &request); err != nil {
+		return err
+	}
+
+	if len(p.entries) == 0 || p.entries[0].Direction != RecordSend {
+		return &errors.LsmError{
+			Code:    errors.TransPortCommunication,
+			Message: fmt.Sprintf("replay: unexpected request %s, recording has no more requests", request.Method)}
+	}
+
+	var recorded requestMsg
+	json.Unmarshal([]byte(p.entries[0].Message), &recorded)
+	if recorded.Method != request.Method {
+		return &errors.LsmError{
+			Code:    errors.TransPortCommunication,
+			Message: fmt.Sprintf("replay: request %s does not match recorded request %s", request.Method, recorded.Method)}
+	}
+
+	p.entries = p.entries[1:]
+	for len(p.entries) > 0 && p.entries[0].Direction == RecordRecv {
+		p.pending = append(p.pending, replyWithID(p.entries[0].Message, recorded.ID, request.ID))
+		p.entries = p.entries[1:]
+	}
+	return nil
+}
+
+// replyWithID returns reply with its ID changed from the recorded request ID
+// to the ID of the request being replayed.  Replies which don't parse are
+// returned as they are, they may well be what is being reproduced.
+func replyWithID(reply string, recordedID int, id int) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(reply), &fields) != nil {
+		return reply
+	}
+
+	var replyID int
+	if json.Unmarshal(fields["id"], &replyID) != nil || replyID != recordedID {
+		return reply
+	}
+
+	fields["id"] = json.RawMessage(fmt.Sprintf("%d", id))
+	rc, err := json.Marshal(fields)
+	if err != nil {
+		return reply
+	}
+	return string(rc)
+}
+
+func (p *replay) Recv() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, io.ErrClosedPipe
+	}
+	if len(p.pending) == 0 {
+		return nil, io.EOF
+	}
+
+	msg := p.pending[0]
+	p.pending = p.pending[1:]
+	return []byte(msg), nil
+}
+
+func (p *replay) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *replay) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
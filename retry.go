@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// RetryPolicy describes how calls failing with a transient error are
+// retried, see ClientConnection.RetryPolicySet.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is made at most, including
+	// the first one.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, it doubles for
+	// every retry after that up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Jitter randomly varies each delay by up to this fraction of it, so
+	// clients failing together don't retry together.
+	Jitter float64
+
+	// ReadOnlyCodes are the error codes after which calls that only retrieve
+	// information are retried.
+	ReadOnlyCodes []errors.ErrorCode
+
+	// MutatingCodes are the error codes after which calls that change state
+	// are retried.  Only codes which guarantee the plugin did not act on the
+	// call belong here.
+	MutatingCodes []errors.ErrorCode
+}
+
+// DefaultRetryPolicy returns a policy retrying calls up to 4 times over a few
+// seconds.  Read only calls are retried after TimeOut, NetworkError,
+// NetworkHostDown and PoolNotReady, calls changing state only after
+// NetworkHostDown and PoolNotReady.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Jitter:         0.2,
+		ReadOnlyCodes: []errors.ErrorCode{errors.TimeOut, errors.NetworkError, errors.NetworkHostDown,
+			errors.PoolNotReady},
+		MutatingCodes: []errors.ErrorCode{errors.NetworkHostDown, errors.PoolNotReady},
+	}
+}
+
+// RetryPolicySet enables retrying calls which fail with a transient error
+// according to policy, nil disables retries, which is the default.  The
+// returned error records how many attempts were made.  A TimeOut leaves the
+// connection unusable, so retrying after it requires AutoReconnectSet.
+func (c *ClientConnection) RetryPolicySet(policy *RetryPolicy) {
+	c.reg.mu.Lock()
+	defer c.reg.mu.Unlock()
+	c.reg.retry = policy
+}
+
+func (c *ClientConnection) retryPolicy() *RetryPolicy {
+	c.reg.mu.Lock()
+	defer c.reg.mu.Unlock()
+	return c.reg.retry
+}
+
+func (p *RetryPolicy) retryable(cmd string, err error) bool {
+	c, ok := errors.Code(err)
+	if !ok {
+		return false
+	}
+
+	codes := p.MutatingCodes
+	if isReadOnly(cmd) {
+		codes = p.ReadOnlyCodes
+	}
+	for _, code := range codes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, the first one being 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// do calls attempt until it succeeds, fails with an error which can't be
+// retried or the attempts run out.
+func (p *RetryPolicy) do(ctx context.Context, cmd string, attempt func() error) error {
+	var err error
+	var n int
+	for {
+		n++
+		err = attempt()
+		if err == nil || n >= p.MaxAttempts || cmd == "plugin_unregister" || !p.retryable(cmd, err) {
+			break
+		}
+		if ctxError := sleep(ctx, p.backoff(n)); ctxError != nil {
+			err = contextError(cmd, ctxError)
+			break
+		}
+	}
+
+	if lsmError, ok := err.(*errors.LsmError); ok {
+		withAttempts := *lsmError
+		withAttempts.Attempts = n
+		return &withAttempts
+	}
+	return err
+}
+
+// sleep waits for d to pass, returning early with the error of ctx if it is
+// done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"fmt"
+	"strings"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+// searchKeys lists for each method returning a list the keys it can be
+// searched by, as in the libStorageMgmt C API.
+var searchKeys = map[string][]string{
+	"pools":         {"id", "system_id"},
+	"volumes":       {"id", "system_id", "pool_id"},
+	"disks":         {"id", "system_id"},
+	"fs":            {"id", "system_id", "pool_id"},
+	"exports":       {"id", "fs_id"},
+	"access_groups": {"id", "system_id"},
+	"target_ports":  {"id", "system_id"},
+	"batteries":     {"id", "system_id"},
+}
+
+// PoolFilter selects the pools returned by PoolsMatching, the zero value
+// selects every pool.  At most one field may be set.
+type PoolFilter struct {
+	ID       string
+	SystemID string
+}
+
+// VolumeFilter selects the volumes returned by VolumesMatching, the zero
+// value selects every volume.  At most one field may be set.
+type VolumeFilter struct {
+	ID       string
+	SystemID string
+	PoolID   string
+}
+
+// DiskFilter selects the disks returned by DisksMatching, the zero value
+// selects every disk.  At most one field may be set.
+type DiskFilter struct {
+	ID       string
+	SystemID string
+}
+
+// FileSystemFilter selects the file systems returned by FileSystemsMatching,
+// the zero value selects every file system.  At most one field may be set.
+type FileSystemFilter struct {
+	ID       string
+	SystemID string
+	PoolID   string
+}
+
+// NfsExportFilter selects the exports returned by NfsExportsMatching, the
+// zero value selects every export.  At most one field may be set.
+type NfsExportFilter struct {
+	ID   string
+	FsID string
+}
+
+// AccessGroupFilter selects the access groups returned by
+// AccessGroupsMatching, the zero value selects every access group.  At most
+// one field may be set.
+type AccessGroupFilter struct {
+	ID       string
+	SystemID string
+}
+
+// TargetPortFilter selects the target ports returned by TargetPortsMatching,
+// the zero value selects every target port.  At most one field may be set.
+type TargetPortFilter struct {
+	ID       string
+	SystemID string
+}
+
+// BatteryFilter selects the batteries returned by BatteriesMatching, the zero
+// value selects every battery.  At most one field may be set.
+type BatteryFilter struct {
+	ID       string
+	SystemID string
+}
+
+func (f PoolFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID)
+}
+
+func (f VolumeFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID, "pool_id", f.PoolID)
+}
+
+func (f DiskFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID)
+}
+
+func (f FileSystemFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID, "pool_id", f.PoolID)
+}
+
+func (f NfsExportFilter) search() []string {
+	return filterSearch("id", f.ID, "fs_id", f.FsID)
+}
+
+func (f AccessGroupFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID)
+}
+
+func (f TargetPortFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID)
+}
+
+func (f BatteryFilter) search() []string {
+	return filterSearch("id", f.ID, "system_id", f.SystemID)
+}
+
+// filterSearch returns the key and value of every pair given whose value is
+// set.
+func filterSearch(pairs ...string) []string {
+	var rc []string
+	for i := 0; i < len(pairs); i += 2 {
+		if len(pairs[i+1]) > 0 {
+			rc = append(rc, pairs[i], pairs[i+1])
+		}
+	}
+	return rc
+}
+
+// checkFilter checks the search of a filter has at most one key.
+func checkFilter(cmd string, search []string) error {
+	if len(search) <= 2 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(search)/2)
+	for i := 0; i < len(search); i += 2 {
+		keys = append(keys, search[i])
+	}
+	return &errors.LsmError{
+		Code: errors.UnsupportedSearchKey,
+		Message: fmt.Sprintf("%s can only be searched by one key at a time, given %s",
+			cmd, strings.Join(keys, ", "))}
+}
+
+// searchArgs adds the search key and value to args, checking the key is one
+// cmd supports.
+func searchArgs(cmd string, args map[string]interface{}, search []string) error {
+	if !handleSearch(args, search) {
+		return &errors.LsmError{
+			Code: errors.InvalidArgument,
+			Message: fmt.Sprintf(
+				"%s supports 0 or 2 search parameters (key, value), provided %d", cmd, len(search))}
+	}
+	if len(search) == 0 {
+		return nil
+	}
+	return checkSearchKey(cmd, search[0])
+}
+
+func checkSearchKey(cmd string, key string) error {
+	for _, k := range searchKeys[cmd] {
+		if k == key {
+			return nil
+		}
+	}
+	return &errors.LsmError{
+		Code: errors.UnsupportedSearchKey,
+		Message: fmt.Sprintf("%s can't be searched by %q, supported keys: %s",
+			cmd, key, strings.Join(searchKeys[cmd], ", "))}
+}
@@ -3,12 +3,23 @@
 package libstoragemgmt
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -1625,6 +1636,2130 @@ func TestClassSerDes(t *testing.T) {
 	}
 }
 
+// udsPlugin hands every connection made to the returned URI to serve, with
+// LSM_UDS_PATH redirected for the duration of the test.
+func udsPlugin(t *testing.T, serve func(conn net.Conn)) string {
+	const KEY = "LSM_UDS_PATH"
+	var current = os.Getenv(KEY)
+
+	dir, err := ioutil.TempDir("", "lsm_go_")
+	assert.Nil(t, err)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "gotest"))
+	assert.Nil(t, err)
+	os.Setenv(KEY, dir)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		os.Setenv(KEY, current)
+		os.RemoveAll(dir)
+	})
+	return "gotest://"
+}
+
+// goPlugin serves the supplied callbacks from an in-process plugin.
+func goPlugin(t *testing.T, cb *lsm.PluginCallBacks) string {
+	return udsPlugin(t, goPluginServe(cb))
+}
+
+func goPluginServe(cb *lsm.PluginCallBacks) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+
+		f, _ := conn.(*net.UnixConn).File()
+		fd, _ := syscall.Dup(int(f.Fd()))
+		f.Close()
+
+		p, err := lsm.PluginInit(cb, []string{"gotest", strconv.Itoa(fd)}, "go test plugin", "0.0.1")
+		if err != nil {
+			return
+		}
+		p.Run()
+	}
+}
+
+func goPluginCallBacks() *lsm.PluginCallBacks {
+	var tmo uint32
+	return &lsm.PluginCallBacks{
+		Mgmt: lsm.ManagementOps{
+			PluginRegister:   func(p *lsm.PluginRegister) error { atomic.StoreUint32(&tmo, p.Timeout); return nil },
+			PluginUnregister: func() error { return nil },
+			TimeOutSet:       func(timeout uint32) error { atomic.StoreUint32(&tmo, timeout); return nil },
+			TimeOutGet:       func() uint32 { return atomic.LoadUint32(&tmo) },
+			Systems: func() ([]lsm.System, error) {
+				return []lsm.System{{ID: "go-01", Name: "go test system"}}, nil
+			},
+		},
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	var release = make(chan struct{})
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		<-release
+		return []lsm.Pool{}, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	var _, pE = c.WithContext(ctx).Pools()
+	assert.NotNil(t, pE)
+	assert.Equal(t, errors.ContextExpired, pE.(*errors.LsmError).Code)
+	close(release)
+
+	// The aborted call leaves the connection unusable
+	_, sE := c.Systems()
+	assert.NotNil(t, sE)
+	assert.Equal(t, errors.TransPortCommunication, sE.(*errors.LsmError).Code)
+
+	c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, sE = c.WithContext(ctx).Systems()
+	assert.NotNil(t, sE)
+	assert.Equal(t, errors.ContextExpired, sE.(*errors.LsmError).Code)
+	assert.Nil(t, c.Close())
+}
+
+func TestContextJobWait(t *testing.T) {
+	var cb = goPluginCallBacks()
+	cb.Mgmt.JobStatus = func(jobID string) (*lsm.JobInfo, error) {
+		return &lsm.JobInfo{Status: lsm.JobStatusInProgress, Percent: 10}, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*600)
+	defer cancel()
+
+	var start = time.Now()
+	var waitErr = c.WithContext(ctx).JobWait("forever", nil)
+	assert.NotNil(t, waitErr)
+	assert.Equal(t, errors.ContextExpired, waitErr.(*errors.LsmError).Code)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second*5))
+
+	assert.Nil(t, c.Close())
+}
+
+func TestClientTimeOut(t *testing.T) {
+	var release = make(chan struct{})
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		<-release
+		return []lsm.Pool{}, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, 100)
+	assert.Nil(t, err)
+
+	c.TimeOutGraceSet(time.Millisecond * 50)
+	assert.Equal(t, time.Millisecond*50, c.TimeOutGraceGet())
+
+	var _, pE = c.Pools()
+	assert.NotNil(t, pE)
+	assert.Equal(t, errors.TimeOut, pE.(*errors.LsmError).Code)
+	close(release)
+
+	// Late reply must not be taken as the answer to the next call
+	_, sE := c.Systems()
+	assert.NotNil(t, sE)
+	assert.Equal(t, errors.TransPortCommunication, sE.(*errors.LsmError).Code)
+}
+
+// replyPlugin answers every request with the reply ID returned by id.
+func replyPlugin(t *testing.T, id func(requestID int) int) string {
+	return rawPlugin(t, func(method string, requestID int) string {
+		return fmt.Sprintf(`{"id": %d, "result": []}`, id(requestID))
+	})
+}
+
+// rawPlugin answers every request with what reply returns for it.
+func rawPlugin(t *testing.T, reply func(method string, requestID int) string) string {
+	return udsPlugin(t, func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			var hdr = make([]byte, 10)
+			if _, err := io.ReadFull(conn, hdr); err != nil {
+				return
+			}
+			var msgLen, _ = strconv.Atoi(string(hdr))
+			var msg = make([]byte, msgLen)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+
+			var request struct {
+				ID     int    `json:"id"`
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &request)
+
+			var r = reply(request.Method, request.ID)
+			conn.Write([]byte(fmt.Sprintf("%010d%s", len(r), r)))
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	var ids []int
+	var c, err = lsm.Client(replyPlugin(t, func(requestID int) int {
+		ids = append(ids, requestID)
+		return requestID
+	}), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	_, err = c.Systems()
+	assert.Nil(t, err)
+	_, err = c.Pools()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, len(ids))
+	assert.Less(t, ids[0], ids[1])
+	assert.Less(t, ids[1], ids[2])
+}
+
+func TestRequestIDLegacy(t *testing.T) {
+	var c, err = lsm.Client(replyPlugin(t, func(requestID int) int {
+		return 100
+	}), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	_, err = c.Systems()
+	assert.Nil(t, err)
+}
+
+func TestRequestIDMismatch(t *testing.T) {
+	// Register succeeds, everything after gets a reply for some other request
+	var calls = 0
+	var c, err = lsm.Client(replyPlugin(t, func(requestID int) int {
+		calls++
+		if calls > 1 {
+			return requestID + 1000
+		}
+		return requestID
+	}), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortCommunication, err.(*errors.LsmError).Code)
+
+	_, err = c.Pools()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortCommunication, err.(*errors.LsmError).Code)
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		return []lsm.Pool{{ID: "pool-01"}, {ID: "pool-02"}}, nil
+	}
+	cb.San.Volumes = func(search []string, flags uint64) ([]lsm.Volume, error) {
+		return []lsm.Volume{{ID: "vol-01"}}, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	const workers = 16
+	const calls = 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < calls; i++ {
+				switch (w + i) % 4 {
+				case 0:
+					pools, pE := c.Pools()
+					assert.Nil(t, pE)
+					assert.Equal(t, 2, len(pools))
+				case 1:
+					volumes, vE := c.Volumes()
+					assert.Nil(t, vE)
+					assert.Equal(t, "vol-01", volumes[0].ID)
+				case 2:
+					systems, sE := c.Systems()
+					assert.Nil(t, sE)
+					assert.Equal(t, "go-01", systems[0].ID)
+				case 3:
+					assert.Nil(t, c.TimeOutSet(TMO))
+					c.TimeOutGet()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Nil(t, c.Close())
+}
+
+func TestClientPool(t *testing.T) {
+	var registered, unregistered, active, maxActive int32
+	var cb = goPluginCallBacks()
+	cb.Mgmt.PluginRegister = func(p *lsm.PluginRegister) error {
+		atomic.AddInt32(&registered, 1)
+		return nil
+	}
+	cb.Mgmt.PluginUnregister = func() error {
+		atomic.AddInt32(&unregistered, 1)
+		return nil
+	}
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		var now = atomic.AddInt32(&active, 1)
+		for {
+			var max = atomic.LoadInt32(&maxActive)
+			if now <= max || atomic.CompareAndSwapInt32(&maxActive, max, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 5)
+		atomic.AddInt32(&active, -1)
+		return []lsm.Pool{{ID: "pool-01"}}, nil
+	}
+
+	var _, err = lsm.NewClientPool(URI, PASSWORD, TMO, 0)
+	assert.NotNil(t, err)
+
+	pool, err := lsm.NewClientPool(goPlugin(t, cb), PASSWORD, TMO, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&registered))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.Nil(t, pool.Do(context.Background(), func(c *lsm.ClientConnection) error {
+					var _, pE = c.Pools()
+					return pE
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxActive), int32(3))
+	assert.LessOrEqual(t, atomic.LoadInt32(&registered), int32(3))
+
+	assert.Nil(t, pool.Close())
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&registered) == atomic.LoadInt32(&unregistered)
+	}, time.Second, time.Millisecond*10)
+
+	var _, getErr = pool.Get(context.Background())
+	assert.NotNil(t, getErr)
+}
+
+func TestClientPoolReplace(t *testing.T) {
+	var registered int32
+	var release = make(chan struct{})
+	var cb = goPluginCallBacks()
+	cb.Mgmt.PluginRegister = func(p *lsm.PluginRegister) error {
+		atomic.AddInt32(&registered, 1)
+		return nil
+	}
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		<-release
+		return []lsm.Pool{}, nil
+	}
+
+	pool, err := lsm.NewClientPool(goPlugin(t, cb), PASSWORD, TMO, 1)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	var doErr = pool.Do(ctx, func(c *lsm.ClientConnection) error {
+		var _, pE = c.Pools()
+		return pE
+	})
+	assert.NotNil(t, doErr)
+	close(release)
+
+	// The connection which failed is replaced with a new one
+	assert.Nil(t, pool.Do(context.Background(), func(c *lsm.ClientConnection) error {
+		var _, sE = c.Systems()
+		return sE
+	}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&registered))
+	assert.Nil(t, pool.Close())
+}
+
+func TestClientPoolIdleCheck(t *testing.T) {
+	var registered int32
+	var cb = goPluginCallBacks()
+	cb.Mgmt.PluginRegister = func(p *lsm.PluginRegister) error {
+		atomic.AddInt32(&registered, 1)
+		return nil
+	}
+
+	var conns = make(chan net.Conn, 8)
+	var serve = goPluginServe(cb)
+	var uri = udsPlugin(t, func(conn net.Conn) {
+		conns <- conn
+		serve(conn)
+	})
+
+	pool, err := lsm.NewClientPool(uri, PASSWORD, TMO, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, pool.Do(context.Background(), func(c *lsm.ClientConnection) error {
+		var _, sE = c.Systems()
+		return sE
+	}))
+
+	// The plugin closes the idle connection, it is replaced before use
+	var conn = (<-conns).(*net.UnixConn)
+	conn.CloseRead()
+	conn.CloseWrite()
+
+	assert.Nil(t, pool.Do(context.Background(), func(c *lsm.ClientConnection) error {
+		var _, sE = c.Systems()
+		return sE
+	}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&registered))
+
+	// A live idle connection is reused
+	assert.Nil(t, pool.Do(context.Background(), func(c *lsm.ClientConnection) error {
+		var _, sE = c.Systems()
+		return sE
+	}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&registered))
+	assert.Nil(t, pool.Close())
+}
+
+func TestAutoReconnect(t *testing.T) {
+	var registered int32
+	var tmo uint32
+	var cb = goPluginCallBacks()
+	cb.Mgmt.PluginRegister = func(p *lsm.PluginRegister) error {
+		atomic.AddInt32(&registered, 1)
+		atomic.StoreUint32(&tmo, p.Timeout)
+		return nil
+	}
+	cb.Mgmt.TimeOutSet = func(timeout uint32) error {
+		atomic.StoreUint32(&tmo, timeout)
+		return nil
+	}
+
+	var conns = make(chan net.Conn, 8)
+	var serve = goPluginServe(cb)
+	var uri = udsPlugin(t, func(conn net.Conn) {
+		conns <- conn
+		serve(conn)
+	})
+
+	// Simulates the plugin going away
+	var restart = func() {
+		var conn = (<-conns).(*net.UnixConn)
+		conn.CloseRead()
+		conn.CloseWrite()
+	}
+
+	var c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+	assert.Nil(t, c.TimeOutSet(TMO+1))
+
+	// Not enabled by default
+	restart()
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortCommunication, err.(*errors.LsmError).Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&registered))
+
+	c.AutoReconnectSet(true)
+	systems, err := c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(systems))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&registered))
+	assert.Equal(t, TMO+1, atomic.LoadUint32(&tmo))
+
+	// Read only calls are retried transparently
+	restart()
+	_, err = c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&registered))
+
+	// Calls changing state are not
+	restart()
+	_, err = c.VolumeDelete(&lsm.Volume{ID: "vol-01"}, true)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortCommunication, err.(*errors.LsmError).Code)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&registered))
+
+	_, err = c.Systems()
+	assert.Nil(t, err)
+	assert.Nil(t, c.Close())
+}
+
+func TestPipeTransport(t *testing.T) {
+	var clientSide, pluginSide = lsm.NewPipeTransport()
+	var p = lsm.PluginWithTransport(goPluginCallBacks(), pluginSide, "go test plugin", "0.0.1")
+
+	var done = make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+
+	var c, err = lsm.ClientWithTransport(context.Background(), clientSide, "pipe://", PASSWORD, TMO)
+	assert.Nil(t, err)
+	assert.Equal(t, "pipe", c.PluginName)
+
+	systems, err := c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(systems))
+	assert.Equal(t, "go-01", systems[0].ID)
+
+	assert.Equal(t, TMO, c.TimeOutGet())
+
+	// Unsupported calls are answered without breaking the connection
+	_, err = c.Volumes()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.NoSupport, err.(*errors.LsmError).Code)
+
+	assert.Nil(t, c.Close())
+	<-done
+}
+
+func TestPipeTransportCancel(t *testing.T) {
+	// Nothing serves the plugin end, so the request can never be answered
+	var clientSide, _ = lsm.NewPipeTransport()
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var _, err = lsm.ClientWithTransport(ctx, clientSide, "pipe://", PASSWORD, TMO)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ContextExpired, err.(*errors.LsmError).Code)
+}
+
+type logRecord struct {
+	level string
+	msg   string
+	attrs map[string]interface{}
+}
+
+type testLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *testLogger) add(level string, msg string, args []interface{}) {
+	var r = logRecord{level: level, msg: msg, attrs: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		r.attrs[args[i].(string)] = args[i+1]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.add("debug", msg, args) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.add("error", msg, args) }
+
+func (l *testLogger) method(method string) []logRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var rc []logRecord
+	for _, r := range l.records {
+		if r.attrs["method"] == method {
+			rc = append(rc, r)
+		}
+	}
+	return rc
+}
+
+func TestLogger(t *testing.T) {
+	var clientLog, pluginLog testLogger
+	var secret = "not-for-logs"
+	var clientSide, pluginSide = lsm.NewPipeTransport()
+	var p = lsm.PluginWithTransport(goPluginCallBacks(), pluginSide, "go test plugin", "0.0.1")
+	p.LoggerSet(&pluginLog)
+
+	var done = make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+
+	var c, err = lsm.ClientWithTransport(context.Background(), clientSide, "pipe://", secret, TMO)
+	assert.Nil(t, err)
+	c.LoggerSet(&clientLog)
+
+	_, err = c.Systems()
+	assert.Nil(t, err)
+
+	assert.NotNil(t, c.IscsiChapAuthSet("iqn.1994-05.com.domain:01.89bd01", nil, &secret, nil, &secret))
+	assert.Nil(t, c.Close())
+	<-done
+
+	var calls = clientLog.method("systems")
+	assert.Equal(t, 1, len(calls))
+	assert.Equal(t, "debug", calls[0].level)
+	assert.IsType(t, time.Duration(0), calls[0].attrs["duration"])
+	assert.Greater(t, calls[0].attrs["request_size"], 0)
+	assert.NotContains(t, calls[0].attrs, "error_code")
+
+	calls = clientLog.method("iscsi_chap_auth")
+	assert.Equal(t, 1, len(calls))
+	assert.Equal(t, errors.NoSupport, calls[0].attrs["error_code"])
+
+	var requests = pluginLog.method("plugin_register")
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "debug", requests[0].level)
+	assert.Equal(t, 1, len(pluginLog.method("systems")))
+	requests = pluginLog.method("iscsi_chap_auth")
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, errors.NoSupport, requests[0].attrs["error_code"])
+
+	// Passwords must never reach the log
+	for _, l := range []*testLogger{&clientLog, &pluginLog} {
+		for _, r := range l.records {
+			var text = fmt.Sprintf("%v", r.attrs)
+			assert.NotContains(t, text, secret)
+		}
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var l = lsm.NewTextLogger(&buf)
+	l.Error("call failed", "method", "systems", "error_code", errors.TimeOut)
+	assert.Contains(t, buf.String(), `level=ERROR msg="call failed" method=systems error_code=`)
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Systems = func() ([]lsm.System, error) {
+		var systems = make([]lsm.System, 1000)
+		for i := range systems {
+			systems[i] = lsm.System{ID: fmt.Sprintf("sys-%d", i), Name: strings.Repeat("n", 64)}
+		}
+		return systems, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	systems, err := c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(systems))
+	assert.Equal(t, "sys-999", systems[999].ID)
+
+	c.MaxFrameSizeSet(4096)
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortSerialization, err.(*errors.LsmError).Code)
+
+	// The oversized reply was not read, so the connection is out of step
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortCommunication, err.(*errors.LsmError).Code)
+}
+
+func TestMaxFrameSizeHeader(t *testing.T) {
+	// A header claiming a huge message must not be trusted
+	var uri = udsPlugin(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 10))
+		conn.Write([]byte("9999999999{}"))
+		io.Copy(ioutil.Discard, conn)
+	})
+
+	var _, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortSerialization, err.(*errors.LsmError).Code)
+}
+
+func TestUnexpectedReply(t *testing.T) {
+	var uri = rawPlugin(t, func(method string, id int) string {
+		switch method {
+		case "pools":
+			return fmt.Sprintf(`{"id": %d, "result": "not a list"}`, id)
+		case "volumes":
+			return fmt.Sprintf(`{"id": %d, "result": [{"class": "Volume"`, id)
+		}
+		return fmt.Sprintf(`{"id": %d, "result": []}`, id)
+	})
+
+	var c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	_, err = c.Pools()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.PluginBug, err.(*errors.LsmError).Code)
+
+	_, err = c.Volumes()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.PluginBug, err.(*errors.LsmError).Code)
+
+	// The bad replies were skipped in full, the next one is still found
+	systems, err := c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(systems))
+	assert.Nil(t, c.Close())
+}
+
+func TestReplyResultAfterID(t *testing.T) {
+	var capabilities = func(reply string, idOffset int) (*lsm.Capabilities, error) {
+		var uri = rawPlugin(t, func(method string, id int) string {
+			if method == "capabilities" {
+				return fmt.Sprintf(reply, id+idOffset)
+			}
+			return fmt.Sprintf(`{"id": %d, "result": []}`, id)
+		})
+		var c, err = lsm.Client(uri, PASSWORD, TMO)
+		assert.Nil(t, err)
+		defer c.Close()
+		return c.Capabilities(&lsm.System{ID: "sim-01"})
+	}
+	const resultFirst = `{"result": {"class": "Capabilities", "cap": "0101"}, "id": %d}`
+	const idFirst = `{"id": %d, "result": {"class": "Capabilities", "cap": "0101"}}`
+
+	// A result isn't stored until the ID shows it is the one asked for
+	for _, reply := range []string{resultFirst, idFirst} {
+		caps, err := capabilities(reply, 1)
+		assert.True(t, errors.IsTransport(err), "%v", err)
+		assert.Empty(t, caps.Cap)
+	}
+
+	// Buffered when the ID comes last
+	caps, err := capabilities(resultFirst, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "0101", caps.Cap)
+}
+
+func recordedSession(t *testing.T, c *lsm.ClientConnection, secret string) []lsm.System {
+	var systems, err = c.Systems()
+	assert.Nil(t, err)
+	assert.Nil(t, c.TimeOutSet(TMO+1))
+	err = c.IscsiChapAuthSet("iqn.1994-05.com.domain:01.89bd01", nil, &secret, nil, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.NoSupport, err.(*errors.LsmError).Code)
+	assert.Nil(t, c.Close())
+	return systems
+}
+
+func TestRecordReplay(t *testing.T) {
+	var secret = "not-for-recordings"
+	var recording bytes.Buffer
+
+	var clientSide, pluginSide = lsm.NewPipeTransport()
+	var p = lsm.PluginWithTransport(goPluginCallBacks(), pluginSide, "go test plugin", "0.0.1")
+	go p.Run()
+
+	var c, err = lsm.ClientWithTransport(context.Background(), lsm.NewRecorder(clientSide, &recording),
+		"pipe://", secret, TMO)
+	assert.Nil(t, err)
+	var recorded = recordedSession(t, c, secret)
+	assert.Equal(t, 1, len(recorded))
+	assert.NotContains(t, recording.String(), secret)
+
+	var lines = strings.Split(strings.TrimSpace(recording.String()), "\n")
+	assert.Equal(t, 10, len(lines))
+	var entry lsm.RecordEntry
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, lsm.RecordSend, entry.Direction)
+	assert.Contains(t, entry.Message, "plugin_register")
+
+	// Played back without the plugin
+	var data = recording.String()
+	replay, err := lsm.NewReplayTransport(strings.NewReader(data))
+	assert.Nil(t, err)
+	c, err = lsm.ClientWithTransport(context.Background(), replay, "pipe://", "", TMO)
+	assert.Nil(t, err)
+	assert.Equal(t, recorded, recordedSession(t, c, secret))
+
+	// Deviating from the recording is an error
+	replay, err = lsm.NewReplayTransport(strings.NewReader(data))
+	assert.Nil(t, err)
+	c, err = lsm.ClientWithTransport(context.Background(), replay, "pipe://", "", TMO)
+	assert.Nil(t, err)
+	_, err = c.Pools()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.TransPortCommunication, err.(*errors.LsmError).Code)
+}
+
+func TestRecordEnv(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "session.jsonl")
+	os.Setenv("LSM_GO_RECORD", path)
+	var c, err = lsm.Client(goPlugin(t, goPluginCallBacks()), PASSWORD, TMO)
+	os.Unsetenv("LSM_GO_RECORD")
+	assert.Nil(t, err)
+	recordedSession(t, c, "secret")
+
+	var f, openErr = os.Open(path)
+	assert.Nil(t, openErr)
+	defer f.Close()
+	replay, err := lsm.NewReplayTransport(f)
+	assert.Nil(t, err)
+	c, err = lsm.ClientWithTransport(context.Background(), replay, "gotest://", "", TMO)
+	assert.Nil(t, err)
+	systems := recordedSession(t, c, "secret")
+	assert.Equal(t, "go-01", systems[0].ID)
+}
+
+func TestRecordStream(t *testing.T) {
+	var recording bytes.Buffer
+	var client, plugin = net.Pipe()
+	defer plugin.Close()
+
+	var r = lsm.NewRecorder(lsm.NewConnTransport(client), &recording)
+	defer r.Close()
+	var s, ok = r.(lsm.StreamReceiver)
+	assert.True(t, ok)
+
+	var msg = `{"id": 101, "result": []}`
+	go plugin.Write([]byte(fmt.Sprintf("%010d%s", len(msg), msg)))
+
+	stream, err := s.RecvStream()
+	assert.Nil(t, err)
+	received, err := ioutil.ReadAll(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, string(received))
+
+	var entry lsm.RecordEntry
+	assert.Nil(t, json.Unmarshal(recording.Bytes(), &entry))
+	assert.Equal(t, lsm.RecordRecv, entry.Direction)
+	assert.Equal(t, msg, entry.Message)
+}
+
+func TestInterceptors(t *testing.T) {
+	var c, err = lsm.Client(goPlugin(t, goPluginCallBacks()), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	var mu sync.Mutex
+	var trace []string
+	var tracer = func(name string) lsm.Interceptor {
+		return func(ctx context.Context, method string, args map[string]interface{}, result interface{},
+			next lsm.Invoker) error {
+			mu.Lock()
+			trace = append(trace, name+">"+method)
+			mu.Unlock()
+			err := next(ctx, method, args, result)
+			mu.Lock()
+			trace = append(trace, fmt.Sprintf("%s<%s:%v", name, method, err != nil))
+			mu.Unlock()
+			return err
+		}
+	}
+	c.InterceptorAdd(tracer("a"), tracer("b"))
+
+	// Answers pools itself without involving the plugin
+	c.WithContext(context.Background()).InterceptorAdd(func(ctx context.Context, method string,
+		args map[string]interface{}, result interface{}, next lsm.Invoker) error {
+		if method == "pools" {
+			*result.(*[]lsm.Pool) = []lsm.Pool{{ID: "cached-pool"}}
+			return nil
+		}
+		return next(ctx, method, args, result)
+	})
+
+	systems, err := c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, "go-01", systems[0].ID)
+
+	pools, err := c.Pools()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pools))
+	assert.Equal(t, "cached-pool", pools[0].ID)
+
+	_, err = c.Volumes()
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{
+		"a>systems", "b>systems", "b<systems:false", "a<systems:false",
+		"a>pools", "b>pools", "b<pools:false", "a<pools:false",
+		"a>volumes", "b>volumes", "b<volumes:true", "a<volumes:true",
+	}, trace)
+	assert.Nil(t, c.Close())
+}
+
+func TestFlags(t *testing.T) {
+	const force uint64 = 1 << 3
+	var received = make(chan uint64, 1)
+	var cb = goPluginCallBacks()
+	cb.San.Volumes = func(search []string, flags uint64) ([]lsm.Volume, error) {
+		received <- flags
+		return []lsm.Volume{{ID: "vol-01"}}, nil
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		received <- flags
+		return nil, nil
+	}
+	cb.File.FileSystems = func(search []string, flags uint64) ([]lsm.FileSystem, error) {
+		received <- flags
+		return nil, nil
+	}
+	cb.Nfs.ExportAuthTypes = func(flags uint64) ([]string, error) {
+		received <- flags
+		return []string{"standard"}, nil
+	}
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		received <- flags
+		return nil, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	_, err = c.Volumes()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), <-received)
+
+	var forced = c.WithFlags(force)
+	assert.Equal(t, force, forced.Flags())
+	assert.Equal(t, uint64(0), c.Flags())
+
+	_, err = forced.VolumeDelete(&lsm.Volume{ID: "vol-01"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, force, <-received)
+
+	_, err = forced.WithContext(context.Background()).FileSystems()
+	assert.Nil(t, err)
+	assert.Equal(t, force, <-received)
+
+	_, err = forced.NfsExportAuthTypes()
+	assert.Nil(t, err)
+	assert.Equal(t, force, <-received)
+
+	_, err = forced.Pools()
+	assert.Nil(t, err)
+	assert.Equal(t, force, <-received)
+
+	_, err = c.Volumes("id", "vol-01")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), <-received)
+	assert.Nil(t, c.Close())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var failures = make(chan errors.ErrorCode, 16)
+	var calls int32
+	var fail = func() error {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case code := <-failures:
+			return &errors.LsmError{Code: code, Message: "transient"}
+		default:
+			return nil
+		}
+	}
+
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Systems = func() ([]lsm.System, error) {
+		if err := fail(); err != nil {
+			return nil, err
+		}
+		return []lsm.System{{ID: "go-01"}}, nil
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		return nil, fail()
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	// Not enabled by default
+	failures <- errors.NetworkError
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, err.(*errors.LsmError).Attempts)
+
+	var policy = lsm.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxAttempts = 3
+	c.RetryPolicySet(policy)
+
+	atomic.StoreInt32(&calls, 0)
+	failures <- errors.NetworkError
+	failures <- errors.TimeOut
+	systems, err := c.Systems()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(systems))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Gives up after MaxAttempts, recording them
+	atomic.StoreInt32(&calls, 0)
+	for i := 0; i < 3; i++ {
+		failures <- errors.NetworkHostDown
+	}
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.NetworkHostDown, err.(*errors.LsmError).Code)
+	assert.Equal(t, 3, err.(*errors.LsmError).Attempts)
+	assert.Contains(t, err.Error(), "attempts = 3")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Calls changing state are only retried when nothing was done
+	atomic.StoreInt32(&calls, 0)
+	failures <- errors.PoolNotReady
+	_, err = c.VolumeDelete(&lsm.Volume{ID: "vol-01"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	failures <- errors.NetworkError
+	_, err = c.VolumeDelete(&lsm.Volume{ID: "vol-01"}, true)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.NetworkError, err.(*errors.LsmError).Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Errors which aren't transient are returned at once
+	atomic.StoreInt32(&calls, 0)
+	failures <- errors.NotFoundSystem
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Waiting to retry ends with the context
+	policy = lsm.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Hour
+	c.RetryPolicySet(policy)
+	failures <- errors.NetworkError
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.WithContext(ctx).Systems()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ContextExpired, err.(*errors.LsmError).Code)
+	assert.Equal(t, 1, err.(*errors.LsmError).Attempts)
+
+	c.RetryPolicySet(nil)
+	assert.Nil(t, c.Close())
+}
+
+func TestPluginErrors(t *testing.T) {
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Systems = func() ([]lsm.System, error) {
+		return nil, fmt.Errorf("array said no")
+	}
+	cb.San.Volumes = func(search []string, flags uint64) ([]lsm.Volume, error) {
+		return nil, fmt.Errorf("lookup failed: %w", errors.Errorf(errors.NotFoundVolume, "volume %s not found", search[1]))
+	}
+	cb.San.Disks = func(search []string, flags uint64) ([]lsm.Disk, error) {
+		return nil, errors.Wrap(errors.NetworkError, io.ErrUnexpectedEOF, "array connection lost")
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+
+	_, err = c.Systems()
+	assert.NotNil(t, err)
+	var lsmError = err.(*errors.LsmError)
+	assert.Equal(t, errors.PluginBug, lsmError.Code)
+	assert.Equal(t, "array said no", lsmError.Message)
+	assert.Empty(t, lsmError.Data)
+
+	_, err = c.Volumes("id", "vol-01")
+	assert.NotNil(t, err)
+	lsmError = err.(*errors.LsmError)
+	assert.Equal(t, errors.NotFoundVolume, lsmError.Code)
+	assert.Equal(t, "volume vol-01 not found", lsmError.Message)
+	assert.Contains(t, lsmError.Data, "lookup failed")
+
+	_, err = c.Disks()
+	assert.NotNil(t, err)
+	lsmError = err.(*errors.LsmError)
+	assert.Equal(t, errors.NetworkError, lsmError.Code)
+	assert.Equal(t, "array connection lost", lsmError.Message)
+	assert.Equal(t, io.ErrUnexpectedEOF.Error(), lsmError.Data)
+
+	assert.Nil(t, c.Close())
+}
+
+func TestErrorsIsAs(t *testing.T) {
+	var notFound error = &errors.LsmError{Code: errors.NotFoundVolume, Message: "volume vol-01 not found"}
+	var wrapped = fmt.Errorf("deleting: %w", notFound)
+
+	assert.True(t, stderrors.Is(wrapped, errors.ErrNotFoundVolume))
+	assert.False(t, stderrors.Is(wrapped, errors.ErrNotFoundPool))
+	var code, ok = errors.Code(wrapped)
+	assert.True(t, ok)
+	assert.Equal(t, errors.NotFoundVolume, code)
+	_, ok = errors.Code(io.EOF)
+	assert.False(t, ok)
+
+	assert.True(t, errors.IsNotFound(wrapped))
+	assert.False(t, errors.IsNotFound(io.EOF))
+	assert.False(t, errors.IsNotFound(nil))
+	assert.True(t, errors.IsRetryable(errors.Errorf(errors.PoolNotReady, "busy")))
+	assert.False(t, errors.IsRetryable(notFound))
+	assert.True(t, errors.IsNoSupport(errors.ErrNoSupportOnlineChange))
+	assert.True(t, errors.IsTransport(errors.ErrTransPortCommunication))
+	assert.False(t, errors.IsTransport(notFound))
+
+	var cause = errors.Wrap(errors.NetworkError, io.ErrUnexpectedEOF, "array went away")
+	assert.True(t, stderrors.Is(cause, io.ErrUnexpectedEOF))
+	assert.True(t, stderrors.Is(cause, errors.ErrNetworkError))
+
+	cause = errors.Wrap(errors.NetworkError, nil, "array went %s", "away")
+	assert.Equal(t, "array went away", cause.Message)
+	assert.Empty(t, cause.Data)
+	assert.Nil(t, cause.Cause)
+}
+
+func TestErrorsCause(t *testing.T) {
+	// Context errors are kept
+	var c, err = lsm.Client(goPlugin(t, goPluginCallBacks()), PASSWORD, TMO)
+	assert.Nil(t, err)
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.WithContext(ctx).Systems()
+	assert.True(t, stderrors.Is(err, context.Canceled))
+	assert.True(t, stderrors.Is(err, errors.ErrContextExpired))
+	assert.Nil(t, c.Close())
+
+	// As are the json errors about replies
+	var uri = rawPlugin(t, func(method string, id int) string {
+		if method == "pools" {
+			return fmt.Sprintf(`{"id": %d, "result": "not a list"}`, id)
+		}
+		return fmt.Sprintf(`{"id": %d, "result": []}`, id)
+	})
+	c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+	_, err = c.Pools()
+	var typeError *json.UnmarshalTypeError
+	assert.True(t, stderrors.As(err, &typeError))
+	assert.True(t, stderrors.Is(err, errors.ErrPluginBug))
+
+	// And the net errors from the plugin going away
+	var conns = make(chan net.Conn, 1)
+	var serve = goPluginServe(goPluginCallBacks())
+	uri = udsPlugin(t, func(conn net.Conn) {
+		conns <- conn
+		serve(conn)
+	})
+	c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+	var conn = (<-conns).(*net.UnixConn)
+	conn.CloseRead()
+	conn.CloseWrite()
+	_, err = c.Systems()
+	assert.True(t, errors.IsTransport(err))
+	var opError *net.OpError
+	assert.True(t, stderrors.As(err, &opError) || stderrors.Is(err, io.EOF))
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, "NOT_FOUND_VOLUME", errors.NotFoundVolume.String())
+	assert.Equal(t, "PLUGIN_IPC_FAIL", errors.PluginIpcFail.String())
+	assert.Equal(t, errors.ErrorCode(301), errors.PluginIpcFail)
+	assert.Equal(t, "9999", errors.ErrorCode(9999).String())
+
+	for _, code := range errors.Codes() {
+		var text, err = code.MarshalText()
+		assert.Nil(t, err)
+		assert.NotEqual(t, strconv.Itoa(int(code)), string(text))
+
+		var parsed errors.ErrorCode
+		assert.Nil(t, parsed.UnmarshalText(text))
+		assert.Equal(t, code, parsed)
+	}
+
+	var e = &errors.LsmError{Code: errors.NotFoundVolume, Message: "volume vol-01 not found"}
+	assert.Equal(t, "code = NOT_FOUND_VOLUME (205), message = volume vol-01 not found", e.Error())
+
+	// The wire form stays numeric, names are accepted too
+	var wire, err = json.Marshal(e)
+	assert.Nil(t, err)
+	assert.Contains(t, string(wire), `"code":205`)
+
+	var decoded errors.LsmError
+	assert.Nil(t, json.Unmarshal(wire, &decoded))
+	assert.Equal(t, errors.NotFoundVolume, decoded.Code)
+	assert.Nil(t, json.Unmarshal([]byte(`{"code": "POOL_NOT_READY", "message": "busy"}`), &decoded))
+	assert.Equal(t, errors.PoolNotReady, decoded.Code)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"code": "NO_SUCH_CODE"}`), &decoded))
+
+	// Also when the error is held as a value
+	wire, err = json.Marshal(errors.LsmError{Code: errors.NotFoundVolume})
+	assert.Nil(t, err)
+	assert.Contains(t, string(wire), `"code":205`)
+	wire, err = json.Marshal(struct{ Err errors.LsmError }{Err: *e})
+	assert.Nil(t, err)
+	assert.Contains(t, string(wire), `"code":205`)
+
+	// On its own a code marshals to its name
+	text, err := json.Marshal(map[string]errors.ErrorCode{"code": errors.NoSupport})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"code":"NO_SUPPORT"}`, string(text))
+
+	var codes = errors.Codes()
+	assert.True(t, sort.SliceIsSorted(codes, func(i, j int) bool { return codes[i] < codes[j] }))
+	assert.Equal(t, codes, errors.Codes())
+}
+
+// fakeJobs lets a Go plugin run jobs which finish after being polled a given
+// number of times, with a result or an *errors.LsmError.
+type fakeJobs struct {
+	mu     sync.Mutex
+	polls  map[string]int
+	items  map[string]interface{}
+	freed  []string
+	nextID int
+}
+
+func newFakeJobs() *fakeJobs {
+	return &fakeJobs{polls: make(map[string]int), items: make(map[string]interface{})}
+}
+
+func (f *fakeJobs) add(polls int, item interface{}) *string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	var id = fmt.Sprintf("job-%d", f.nextID)
+	f.polls[id] = polls
+	f.items[id] = item
+	return &id
+}
+
+func (f *fakeJobs) status(id string) (*lsm.JobInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n, ok = f.polls[id]
+	if !ok {
+		return nil, &errors.LsmError{Code: errors.NotFoundJob, Message: "no job " + id}
+	}
+	if n > 0 {
+		f.polls[id] = n - 1
+		return &lsm.JobInfo{Status: lsm.JobStatusInProgress, Percent: uint8(100 / (n + 1))}, nil
+	}
+	if e, isError := f.items[id].(*errors.LsmError); isError {
+		return &lsm.JobInfo{Status: lsm.JobStatusError, Item: e}, nil
+	}
+	return &lsm.JobInfo{Status: lsm.JobStatusComplete, Percent: 100, Item: f.items[id]}, nil
+}
+
+func (f *fakeJobs) free(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.polls[id]; !ok {
+		return &errors.LsmError{Code: errors.NotFoundJob, Message: "no job " + id}
+	}
+	delete(f.polls, id)
+	delete(f.items, id)
+	f.freed = append(f.freed, id)
+	return nil
+}
+
+func (f *fakeJobs) outstanding() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.polls)
+}
+
+func (f *fakeJobs) callBacks() *lsm.PluginCallBacks {
+	var cb = goPluginCallBacks()
+	cb.Mgmt.JobStatus = f.status
+	cb.Mgmt.JobFree = f.free
+	return cb
+}
+
+func TestJobHandles(t *testing.T) {
+	var jobs = newFakeJobs()
+	var cb = jobs.callBacks()
+	cb.San.VolumeCreate = func(pool *lsm.Pool, name string, size uint64,
+		prov lsm.VolumeProvisionType, flags uint64) (*lsm.Volume, *string, error) {
+		return nil, jobs.add(2, lsm.Volume{ID: "vol-01", Name: name, PoolID: pool.ID}), nil
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		return jobs.add(1, &errors.LsmError{Code: errors.NotFoundVolume, Message: "gone"}), nil
+	}
+	cb.San.VolumeResize = func(vol *lsm.Volume, newSizeBytes uint64, flags uint64) (*lsm.Volume, *string, error) {
+		return nil, jobs.add(1, &errors.LsmError{Code: errors.TimeOut, Message: "array timed out"}), nil
+	}
+	cb.File.FsSnapShotCreate = func(fs *lsm.FileSystem, name string, flags uint64) (*lsm.FileSystemSnapShot, *string, error) {
+		return &lsm.FileSystemSnapShot{ID: "ss-01", Name: name}, nil, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	var pool = lsm.Pool{ID: "pool-01"}
+	volJob, err := c.VolumeCreateAsync(&pool, "vol", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, volJob.ID())
+
+	status, err := volJob.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, lsm.JobStatusInProgress, status)
+	assert.Equal(t, uint8(33), volJob.Percent())
+
+	vol, err := volJob.Wait(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "vol-01", vol.ID)
+	assert.Equal(t, "pool-01", vol.PoolID)
+	assert.Equal(t, uint8(100), volJob.Percent())
+
+	// Finished jobs are freed, asking again doesn't involve the plugin
+	assert.Equal(t, 0, jobs.outstanding())
+	status, err = volJob.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, lsm.JobStatusComplete, status)
+
+	// A failed job reports the plugin's error and is freed too
+	delJob, err := c.VolumeDeleteAsync(vol)
+	assert.Nil(t, err)
+	err = delJob.Wait(context.Background())
+	assert.True(t, stderrors.Is(err, errors.ErrNotFoundVolume))
+	assert.Equal(t, 0, jobs.outstanding())
+	assert.Len(t, jobs.freed, 2)
+
+	// Even with an error which would be retried were it from the call itself
+	resizeJob, err := c.VolumeResizeAsync(vol, 2048)
+	assert.Nil(t, err)
+	_, err = resizeJob.Wait(context.Background())
+	assert.True(t, stderrors.Is(err, errors.ErrTimeOut), "%v", err)
+	status, statusErr := resizeJob.Status()
+	assert.Equal(t, lsm.JobStatusError, status)
+	assert.Equal(t, err, statusErr)
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// Operations completing at once have no job to wait for
+	ssJob, err := c.FsSnapShotCreateAsync(&lsm.FileSystem{ID: "fs-01"}, "ss")
+	assert.Nil(t, err)
+	assert.Empty(t, ssJob.ID())
+	ss, err := ssJob.Wait(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "ss-01", ss.ID)
+
+	// Giving up waiting leaves the job running until it is freed
+	volJob, err = c.VolumeCreateAsync(&pool, "vol", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = volJob.Wait(ctx)
+	assert.True(t, stderrors.Is(err, errors.ErrContextExpired))
+	assert.Equal(t, 1, jobs.outstanding())
+	assert.Nil(t, volJob.Free())
+	assert.Equal(t, 0, jobs.outstanding())
+	_, err = volJob.Wait(context.Background())
+	assert.True(t, errors.IsNotFound(err))
+
+	// The sync flavours are built on the handles
+	vol, jobID, err := c.VolumeCreate(&pool, "vol", 1024, lsm.VolumeProvisionTypeDefault, true)
+	assert.Nil(t, err)
+	assert.Nil(t, jobID)
+	assert.Equal(t, "vol-01", vol.ID)
+
+	vol, jobID, err = c.VolumeCreate(&pool, "vol", 1024, lsm.VolumeProvisionTypeDefault, false)
+	assert.Nil(t, err)
+	assert.Nil(t, vol)
+	assert.NotNil(t, jobID)
+	assert.Nil(t, c.JobWait(*jobID, nil))
+	assert.Equal(t, 0, jobs.outstanding())
+}
+
+func TestJobPolling(t *testing.T) {
+	var jobs = newFakeJobs()
+	var cb = jobs.callBacks()
+	cb.San.VolumeCreate = func(pool *lsm.Pool, name string, size uint64,
+		prov lsm.VolumeProvisionType, flags uint64) (*lsm.Volume, *string, error) {
+		return nil, jobs.add(3, lsm.Volume{ID: "vol-01", Name: name}), nil
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		return jobs.add(1000, nil), nil
+	}
+	cb.San.VolumeResize = func(vol *lsm.Volume, newSizeBytes uint64, flags uint64) (*lsm.Volume, *string, error) {
+		return nil, jobs.add(2, &errors.LsmError{Code: errors.NetworkError, Message: "array unreachable"}), nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	var progress []uint8
+	var polled = c.WithJobPolling(&lsm.JobPolling{
+		Interval:    time.Millisecond,
+		MaxInterval: time.Millisecond * 20,
+		Progress: func(jobID string, percent uint8) {
+			assert.NotEmpty(t, jobID)
+			progress = append(progress, percent)
+		},
+	})
+
+	var start = time.Now()
+	vol, jobID, err := polled.VolumeCreate(&lsm.Pool{ID: "pool-01"}, "vol", 1024, lsm.VolumeProvisionTypeDefault, true)
+	assert.Nil(t, err)
+	assert.Nil(t, jobID)
+	assert.Equal(t, "vol-01", vol.ID)
+	assert.Equal(t, []uint8{25, 33, 50, 100}, progress)
+	assert.Less(t, int64(time.Since(start)), int64(time.Millisecond*200))
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// Running out of time is a TimeOut, the job is freed as its ID is never
+	// returned
+	polled = polled.WithJobPolling(&lsm.JobPolling{
+		Interval: time.Millisecond * 5, MaxInterval: time.Millisecond * 5, Timeout: time.Millisecond * 50})
+	_, err = polled.VolumeDelete(vol, true)
+	var lsmError *errors.LsmError
+	assert.True(t, stderrors.As(err, &lsmError))
+	assert.Equal(t, errors.TimeOut, lsmError.Code)
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// The same goes for the context expiring
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = c.WithContext(ctx).VolumeDelete(vol, true)
+	assert.True(t, stderrors.Is(err, errors.ErrContextExpired))
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// Without sync the job ID is the caller's to wait on
+	jobID, err = c.VolumeDelete(vol, false)
+	assert.Nil(t, err)
+	err = polled.JobWait(*jobID, nil)
+	assert.True(t, stderrors.Is(err, errors.ErrTimeOut))
+	assert.Equal(t, 1, jobs.outstanding())
+	assert.Nil(t, c.JobFree(*jobID))
+
+	// A job failing with a retryable code has failed all the same, and is
+	// freed whether waited on by ID or not
+	_, jobID, err = c.VolumeResize(vol, 2048, false)
+	assert.Nil(t, err)
+	err = polled.JobWait(*jobID, nil)
+	assert.True(t, stderrors.Is(err, errors.ErrNetworkError), "%v", err)
+	assert.Equal(t, 0, jobs.outstanding())
+
+	_, _, err = polled.VolumeResize(vol, 2048, true)
+	assert.True(t, stderrors.Is(err, errors.ErrNetworkError), "%v", err)
+	assert.Equal(t, 0, jobs.outstanding())
+	assert.Empty(t, c.OutstandingJobs())
+}
+
+func TestJobPollingDefaults(t *testing.T) {
+	var jobs = newFakeJobs()
+	var cb = jobs.callBacks()
+	var polls int32
+	cb.Mgmt.JobStatus = func(id string) (*lsm.JobInfo, error) {
+		atomic.AddInt32(&polls, 1)
+		return jobs.status(id)
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		return jobs.add(1000, nil), nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Fields left zero fall back to the default interval and no limit,
+	// rather than polling without a pause
+	for _, p := range []*lsm.JobPolling{
+		{Timeout: time.Millisecond * 300},
+		{Interval: time.Millisecond * 50, Timeout: time.Millisecond * 300},
+		{MaxInterval: time.Millisecond * 100, Timeout: time.Millisecond * 300},
+	} {
+		atomic.StoreInt32(&polls, 0)
+		_, err = c.WithJobPolling(p).VolumeDelete(&lsm.Volume{ID: "vol-01"}, true)
+		assert.True(t, stderrors.Is(err, errors.ErrTimeOut))
+		assert.LessOrEqual(t, atomic.LoadInt32(&polls), int32(4), "%+v", p)
+	}
+	assert.Equal(t, 0, jobs.outstanding())
+}
+
+func TestJobWaitStuckPlugin(t *testing.T) {
+	var jobs = newFakeJobs()
+	var cb = jobs.callBacks()
+	var release = make(chan struct{})
+	defer close(release)
+	cb.Mgmt.JobStatus = func(id string) (*lsm.JobInfo, error) {
+		<-release
+		return jobs.status(id)
+	}
+
+	// A poll the plugin never answers doesn't outlast the context
+	for _, wait := range []func(c *lsm.ClientConnection, ctx context.Context) error{
+		func(c *lsm.ClientConnection, ctx context.Context) error {
+			return c.WithContext(ctx).JobWait(*jobs.add(1, nil), nil)
+		},
+		func(c *lsm.ClientConnection, ctx context.Context) error {
+			var group lsm.JobGroup
+			group.AddID(c, *jobs.add(1, nil), nil)
+			_, err := group.Wait(ctx)
+			return err
+		},
+	} {
+		var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+		assert.Nil(t, err)
+
+		var ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+		var start = time.Now()
+		err = wait(c, ctx)
+		cancel()
+		assert.True(t, stderrors.Is(err, errors.ErrContextExpired), "%v", err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second*5))
+		c.Close()
+	}
+}
+
+func TestJobGroup(t *testing.T) {
+	var jobs = newFakeJobs()
+	var cb = jobs.callBacks()
+	cb.San.VolumeCreate = func(pool *lsm.Pool, name string, size uint64,
+		prov lsm.VolumeProvisionType, flags uint64) (*lsm.Volume, *string, error) {
+		var polls, _ = strconv.Atoi(name)
+		return nil, jobs.add(polls, lsm.Volume{ID: "vol-" + name, Name: name}), nil
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		return jobs.add(1, &errors.LsmError{Code: errors.HasChildDependency, Message: "busy"}), nil
+	}
+	cb.San.VolumeResize = func(vol *lsm.Volume, newSizeBytes uint64, flags uint64) (*lsm.Volume, *string, error) {
+		return nil, jobs.add(1, &errors.LsmError{Code: errors.PoolNotReady, Message: "pool rebuilding"}), nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	var pool = lsm.Pool{ID: "pool-01"}
+	var fast = &lsm.JobPolling{Interval: time.Millisecond, MaxInterval: time.Millisecond * 5}
+
+	var overall []uint8
+	var perJob = make(map[string]uint8)
+	var group = lsm.JobGroup{
+		Polling: &lsm.JobPolling{
+			Interval:    fast.Interval,
+			MaxInterval: fast.MaxInterval,
+			Progress:    func(jobID string, percent uint8) { perJob[jobID] = percent },
+		},
+		Progress: func(percent uint8) { overall = append(overall, percent) },
+	}
+
+	var handles []*lsm.VolumeJob
+	for _, polls := range []string{"1", "3", "5"} {
+		var vj, err = c.VolumeCreateAsync(&pool, polls, 1024, lsm.VolumeProvisionTypeDefault)
+		assert.Nil(t, err)
+		handles = append(handles, vj)
+		group.Add(vj)
+	}
+
+	// Jobs handed out as IDs can be waited on too
+	var fromID lsm.Volume
+	_, jobID, err := c.VolumeCreate(&pool, "2", 1024, lsm.VolumeProvisionTypeDefault, false)
+	assert.Nil(t, err)
+	group.AddID(c, *jobID, &fromID)
+	assert.Equal(t, 4, group.Len())
+
+	results, err := group.Wait(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, results, 4)
+	for i, r := range results {
+		assert.Equal(t, lsm.JobStatusComplete, r.Status, i)
+		assert.Nil(t, r.Err)
+		assert.Equal(t, uint8(100), perJob[r.ID])
+	}
+	assert.Equal(t, uint8(100), group.Percent())
+	assert.Equal(t, uint8(100), overall[len(overall)-1])
+	for i := 1; i < len(overall); i++ {
+		assert.Greater(t, overall[i], overall[i-1])
+	}
+
+	for i, name := range []string{"1", "3", "5"} {
+		var vol, err = handles[i].Wait(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, "vol-"+name, vol.ID)
+	}
+	assert.Equal(t, "vol-2", fromID.ID)
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// A failure is reported once everything has finished
+	var mixed = lsm.JobGroup{Polling: fast}
+	slow, err := c.VolumeCreateAsync(&pool, "20", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	failing, err := c.VolumeDeleteAsync(&lsm.Volume{ID: "vol-01"})
+	assert.Nil(t, err)
+	mixed.Add(slow, failing)
+
+	results, err = mixed.Wait(context.Background())
+	assert.True(t, stderrors.Is(err, errors.ErrHasChildDependency))
+	assert.Equal(t, lsm.JobStatusComplete, results[0].Status)
+	assert.Equal(t, lsm.JobStatusError, results[1].Status)
+	assert.True(t, stderrors.Is(results[1].Err, errors.ErrHasChildDependency))
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// Also when the job failed with a retryable code
+	var retryable = lsm.JobGroup{Polling: fast}
+	slow, err = c.VolumeCreateAsync(&pool, "20", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	resizing, err := c.VolumeResizeAsync(&lsm.Volume{ID: "vol-01"}, 2048)
+	assert.Nil(t, err)
+	retryable.Add(slow, resizing)
+
+	results, err = retryable.Wait(context.Background())
+	assert.True(t, stderrors.Is(err, errors.ErrPoolNotReady), "%v", err)
+	assert.Equal(t, lsm.JobStatusComplete, results[0].Status)
+	assert.Equal(t, lsm.JobStatusError, results[1].Status)
+	assert.Equal(t, err, results[1].Err)
+	assert.Equal(t, 0, jobs.outstanding())
+
+	// or straight away with FailFast, leaving the rest running
+	var failFast = lsm.JobGroup{Polling: fast, FailFast: true}
+	slow, _ = c.VolumeCreateAsync(&pool, "1000", 1024, lsm.VolumeProvisionTypeDefault)
+	failing, _ = c.VolumeDeleteAsync(&lsm.Volume{ID: "vol-01"})
+	failFast.Add(slow, failing)
+
+	results, err = failFast.Wait(context.Background())
+	assert.True(t, stderrors.Is(err, errors.ErrHasChildDependency))
+	assert.Equal(t, lsm.JobStatusInProgress, results[0].Status)
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, 1, jobs.outstanding())
+
+	// Jobs may be added while waiting
+	var growing = lsm.JobGroup{Polling: fast}
+	first, err := c.VolumeCreateAsync(&pool, "20", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	growing.Add(first)
+	var waited = make(chan []lsm.JobResult)
+	go func() {
+		results, err := growing.Wait(context.Background())
+		assert.Nil(t, err)
+		waited <- results
+	}()
+	second, err := c.VolumeCreateAsync(&pool, "1", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	growing.Add(second)
+	results = <-waited
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, lsm.JobStatusComplete, results[1].Status)
+	assert.Equal(t, 1, jobs.outstanding())
+
+	// Running out of time reports the jobs still running
+	var limited = lsm.JobGroup{Polling: &lsm.JobPolling{Interval: fast.Interval, MaxInterval: fast.MaxInterval,
+		Timeout: time.Millisecond * 50}}
+	limited.Add(slow)
+	_, err = limited.Wait(context.Background())
+	var lsmError *errors.LsmError
+	assert.True(t, stderrors.As(err, &lsmError))
+	assert.Equal(t, errors.TimeOut, lsmError.Code)
+	assert.Contains(t, lsmError.Message, "1 jobs")
+	assert.Nil(t, slow.Free())
+	assert.Equal(t, 0, jobs.outstanding())
+}
+
+func TestOutstandingJobs(t *testing.T) {
+	var jobs = newFakeJobs()
+	var cb = jobs.callBacks()
+	cb.San.VolumeCreate = func(pool *lsm.Pool, name string, size uint64,
+		prov lsm.VolumeProvisionType, flags uint64) (*lsm.Volume, *string, error) {
+		var polls, _ = strconv.Atoi(name)
+		return nil, jobs.add(polls, lsm.Volume{ID: "vol-" + name, Name: name}), nil
+	}
+	var uri = goPlugin(t, cb)
+	var pool = lsm.Pool{ID: "pool-01"}
+
+	var c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+	assert.Empty(t, c.OutstandingJobs())
+
+	// Copies of the connection share what is outstanding
+	_, first, err := c.WithFlags(1).VolumeCreate(&pool, "1", 1024, lsm.VolumeProvisionTypeDefault, false)
+	assert.Nil(t, err)
+	second, err := c.VolumeCreateAsync(&pool, "1", 1024, lsm.VolumeProvisionTypeDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{*first, second.ID()}, c.OutstandingJobs())
+
+	// Jobs are no longer outstanding once freed, however that happens
+	_, err = second.Wait(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{*first}, c.OutstandingJobs())
+	assert.Nil(t, c.JobFree(*first))
+	assert.Empty(t, c.OutstandingJobs())
+
+	// By default Close leaves them behind
+	_, _, err = c.VolumeCreate(&pool, "1", 1024, lsm.VolumeProvisionTypeDefault, false)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Close())
+	assert.Equal(t, 1, jobs.outstanding())
+
+	c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+	c.JobCloseActionSet(lsm.JobCloseFree)
+	_, _, err = c.VolumeCreate(&pool, "1000", 1024, lsm.VolumeProvisionTypeDefault, false)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Close())
+	assert.Equal(t, 1, jobs.outstanding())
+
+	// Waiting lets jobs finish first
+	c, err = lsm.Client(uri, PASSWORD, TMO)
+	assert.Nil(t, err)
+	c = c.WithJobPolling(&lsm.JobPolling{Interval: time.Millisecond, MaxInterval: time.Millisecond})
+	c.JobCloseActionSet(lsm.JobCloseWait)
+	var finished []uint8
+	var withProgress = c.WithJobPolling(&lsm.JobPolling{Interval: time.Millisecond, MaxInterval: time.Millisecond,
+		Progress: func(jobID string, percent uint8) { finished = append(finished, percent) }})
+	_, _, err = withProgress.VolumeCreate(&pool, "3", 1024, lsm.VolumeProvisionTypeDefault, false)
+	assert.Nil(t, err)
+	assert.Nil(t, withProgress.Close())
+	assert.Equal(t, uint8(100), finished[len(finished)-1])
+	assert.Equal(t, 1, jobs.outstanding())
+}
+
+func TestSearchFilters(t *testing.T) {
+	// The plugin runs in its own goroutine
+	var mu sync.Mutex
+	var searched []string
+	var record = func(search []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		searched = search
+	}
+	var last = func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return searched
+	}
+
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		record(search)
+		return []lsm.Pool{{ID: "pool-01"}}, nil
+	}
+	cb.San.Volumes = func(search []string, flags uint64) ([]lsm.Volume, error) {
+		record(search)
+		return []lsm.Volume{{ID: "vol-01"}}, nil
+	}
+	cb.San.Disks = func(search []string, flags uint64) ([]lsm.Disk, error) {
+		record(search)
+		return []lsm.Disk{{ID: "disk-01"}}, nil
+	}
+	cb.San.AccessGroups = func(search []string, flags uint64) ([]lsm.AccessGroup, error) {
+		record(search)
+		return []lsm.AccessGroup{{ID: "ag-01"}}, nil
+	}
+	cb.San.TargetPorts = func(search []string, flags uint64) ([]lsm.TargetPort, error) {
+		record(search)
+		return []lsm.TargetPort{{ID: "tp-01"}}, nil
+	}
+	cb.File.FileSystems = func(search []string, flags uint64) ([]lsm.FileSystem, error) {
+		record(search)
+		return []lsm.FileSystem{{ID: "fs-01"}}, nil
+	}
+	cb.Nfs.Exports = func(search []string, flags uint64) ([]lsm.NfsExport, error) {
+		record(search)
+		return []lsm.NfsExport{{ID: "exp-01"}}, nil
+	}
+	cb.Hba.Batteries = func(search []string, flags uint64) ([]lsm.Battery, error) {
+		record(search)
+		return []lsm.Battery{{ID: "bat-01"}}, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	var unsupported = func(err error) {
+		t.Helper()
+		assert.True(t, stderrors.Is(err, errors.ErrUnsupportedSearchKey), "%v", err)
+	}
+
+	_, err = c.PoolsMatching(lsm.PoolFilter{SystemID: "sys-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"system_id", "sys-01"}, last())
+
+	volumes, err := c.VolumesMatching(lsm.VolumeFilter{PoolID: "pool-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, "vol-01", volumes[0].ID)
+	assert.Equal(t, []string{"pool_id", "pool-01"}, last())
+
+	_, err = c.VolumesMatching(lsm.VolumeFilter{})
+	assert.Nil(t, err)
+	assert.Empty(t, last())
+
+	disks, err := c.DisksMatching(lsm.DiskFilter{ID: "disk-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, "disk-01", disks[0].ID)
+	assert.Equal(t, []string{"id", "disk-01"}, last())
+
+	_, err = c.AccessGroupsMatching(lsm.AccessGroupFilter{SystemID: "sys-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"system_id", "sys-01"}, last())
+
+	_, err = c.TargetPortsMatching(lsm.TargetPortFilter{ID: "tp-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"id", "tp-01"}, last())
+
+	_, err = c.FileSystemsMatching(lsm.FileSystemFilter{PoolID: "pool-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"pool_id", "pool-01"}, last())
+
+	_, err = c.NfsExportsMatching(lsm.NfsExportFilter{FsID: "fs-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fs_id", "fs-01"}, last())
+
+	_, err = c.BatteriesMatching(lsm.BatteryFilter{SystemID: "sys-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"system_id", "sys-01"}, last())
+
+	// Bad searches never reach the plugin
+	record(nil)
+	_, err = c.VolumesMatching(lsm.VolumeFilter{ID: "vol-01", PoolID: "pool-01"})
+	unsupported(err)
+	_, err = c.NfsExports("pool_id", "pool-01")
+	unsupported(err)
+	_, err = c.Disks("pool_id", "pool-01")
+	unsupported(err)
+	_, err = c.AccessGroups("name", "ag")
+	unsupported(err)
+	_, err = c.TargetPorts("system_id")
+	assert.True(t, stderrors.Is(err, errors.ErrInvalidArgument))
+	assert.Nil(t, last())
+
+	// Plugins are protected from clients which don't check
+	c.InterceptorAdd(func(ctx context.Context, method string, args map[string]interface{}, result interface{},
+		next lsm.Invoker) error {
+		args["search_key"] = "pool_id"
+		args["search_value"] = "pool-01"
+		return next(ctx, method, args, result)
+	})
+	_, err = c.Disks()
+	unsupported(err)
+	assert.Nil(t, last())
+}
+
+func TestLookups(t *testing.T) {
+	var mu sync.Mutex
+	var volumes = []lsm.Volume{
+		{ID: "vol-01", Name: "data", PoolID: "pool-01"},
+		{ID: "vol-02", Name: "logs", PoolID: "pool-01"},
+		{ID: "vol-03", Name: "logs", PoolID: "pool-02"},
+	}
+
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Pools = func(search []string, flags uint64) ([]lsm.Pool, error) {
+		return []lsm.Pool{{ID: "pool-01", Name: "fast"}, {ID: "pool-02", Name: "slow"}}, nil
+	}
+	cb.San.Volumes = func(search []string, flags uint64) ([]lsm.Volume, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		var rc []lsm.Volume
+		for _, v := range volumes {
+			if len(search) == 0 || (search[0] == "id" && v.ID == search[1]) {
+				rc = append(rc, v)
+			}
+		}
+		return rc, nil
+	}
+	cb.San.AccessGroups = func(search []string, flags uint64) ([]lsm.AccessGroup, error) {
+		return []lsm.AccessGroup{{ID: "ag-01", Name: "hosts"}}, nil
+	}
+	cb.File.FileSystems = func(search []string, flags uint64) ([]lsm.FileSystem, error) {
+		return []lsm.FileSystem{}, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	vol, err := c.VolumeByID("vol-02")
+	assert.Nil(t, err)
+	assert.Equal(t, "logs", vol.Name)
+
+	vol, err = c.VolumeByName("data")
+	assert.Nil(t, err)
+	assert.Equal(t, "vol-01", vol.ID)
+
+	_, err = c.VolumeByID("vol-99")
+	assert.True(t, errors.IsNotFound(err))
+	assert.True(t, stderrors.Is(err, errors.ErrNotFoundVolume))
+	assert.Contains(t, err.Error(), "vol-99")
+
+	_, err = c.VolumeByName("logs")
+	assert.True(t, stderrors.Is(err, errors.ErrInvalidArgument))
+	_, err = c.VolumeByID("")
+	assert.True(t, stderrors.Is(err, errors.ErrInvalidArgument))
+
+	// Plugins ignoring the search don't confuse lookups by ID
+	pool, err := c.PoolByID("pool-02")
+	assert.Nil(t, err)
+	assert.Equal(t, "slow", pool.Name)
+	pool, err = c.PoolByName("fast")
+	assert.Nil(t, err)
+	assert.Equal(t, "pool-01", pool.ID)
+
+	ag, err := c.AccessGroupByName("hosts")
+	assert.Nil(t, err)
+	assert.Equal(t, "ag-01", ag.ID)
+
+	system, err := c.SystemByID("go-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "go test system", system.Name)
+	_, err = c.SystemByID("")
+	assert.True(t, stderrors.Is(err, errors.ErrInvalidArgument))
+
+	_, err = c.FileSystemByID("fs-01")
+	assert.True(t, stderrors.Is(err, errors.ErrNotFoundFs))
+	_, err = c.AccessGroupByName("nobody")
+	assert.True(t, stderrors.Is(err, errors.ErrNotFoundAccessGroup))
+
+	// Refresh picks up changes made behind our back
+	vol, _ = c.VolumeByID("vol-01")
+	mu.Lock()
+	volumes[0].Name = "renamed"
+	mu.Unlock()
+	assert.Nil(t, c.Refresh(vol))
+	assert.Equal(t, "renamed", vol.Name)
+
+	assert.Nil(t, c.Refresh(pool))
+	assert.Equal(t, "fast", pool.Name)
+
+	mu.Lock()
+	volumes = volumes[1:]
+	mu.Unlock()
+	err = c.Refresh(vol)
+	assert.True(t, stderrors.Is(err, errors.ErrNotFoundVolume))
+	assert.Equal(t, "renamed", vol.Name)
+
+	err = c.Refresh(lsm.Volume{ID: "vol-02"})
+	assert.True(t, stderrors.Is(err, errors.ErrInvalidArgument))
+	err = c.Refresh((*lsm.Volume)(nil))
+	assert.True(t, stderrors.Is(err, errors.ErrInvalidArgument))
+}
+
+// capString returns the wire form of capabilities with the given ones
+// supported.
+func capString(supported ...lsm.CapabilityType) string {
+	var caps = []byte(strings.Repeat("00", 512))
+	for _, c := range supported {
+		caps[c*2+1] = '1'
+	}
+	return string(caps)
+}
+
+func TestCapabilityGuard(t *testing.T) {
+	var capCalls, replicated int32
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Capabilities = func(system *lsm.System) (*lsm.Capabilities, error) {
+		atomic.AddInt32(&capCalls, 1)
+		assert.Equal(t, "go-01", system.ID)
+		return &lsm.Capabilities{Class: "Capabilities",
+			Cap: capString(lsm.CapVolumeCReplicate, lsm.CapVolumeCReplicateClone, lsm.CapVolumeCreate)}, nil
+	}
+	cb.San.VolumeReplicate = func(optionalPool *lsm.Pool, repType lsm.VolumeReplicateType,
+		sourceVolume *lsm.Volume, name string, flags uint64) (*lsm.Volume, *string, error) {
+		atomic.AddInt32(&replicated, 1)
+		return &lsm.Volume{ID: "vol-02", Name: name, SystemID: sourceVolume.SystemID}, nil, nil
+	}
+	cb.San.VolumeCreate = func(pool *lsm.Pool, name string, size uint64,
+		prov lsm.VolumeProvisionType, flags uint64) (*lsm.Volume, *string, error) {
+		return &lsm.Volume{ID: "vol-03", Name: name, SystemID: pool.SystemID}, nil, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	var guard = c.CapabilityGuardAdd()
+	var src = lsm.Volume{ID: "vol-01", SystemID: "go-01"}
+
+	vol, _, err := c.VolumeReplicate(nil, lsm.VolumeReplicateTypeClone, &src, "clone", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "vol-02", vol.ID)
+
+	// Unsupported variants fail without a round trip
+	_, _, err = c.VolumeReplicate(nil, lsm.VolumeReplicateTypeMirrorSync, &src, "mirror", true)
+	assert.True(t, errors.IsNoSupport(err))
+	assert.Contains(t, err.Error(), fmt.Sprint(lsm.CapVolumeCReplicateMirrorSync))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&replicated))
+
+	var pool = lsm.Pool{ID: "pool-01", SystemID: "go-01"}
+	_, err = c.VolumeCreateAsync(&pool, "thick", 1024, lsm.VolumeProvisionTypeFull)
+	assert.Nil(t, err)
+	_, err = c.WithFlags(1).VolumeCreateAsync(&pool, "thin", 1024, lsm.VolumeProvisionTypeThin)
+	assert.True(t, stderrors.Is(err, errors.ErrNoSupport))
+
+	_, err = c.VolumeDelete(&src, true)
+	assert.True(t, errors.IsNoSupport(err))
+
+	// Capabilities are retrieved once per system until forgotten
+	assert.Equal(t, int32(1), atomic.LoadInt32(&capCalls))
+	guard.Forget("go-01")
+	_, _, err = c.VolumeReplicate(nil, lsm.VolumeReplicateTypeClone, &src, "clone", true)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&capCalls))
+
+	// Unknown systems and calls not about one system
+	_, err = c.VolumeDelete(&lsm.Volume{ID: "vol-01", SystemID: "go-99"}, true)
+	assert.True(t, stderrors.Is(err, errors.ErrNotFoundSystem))
+	_, err = c.Systems()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapFsChildDepRm, lsm.CapFsChildDepRmSpecificFiles},
+		lsm.RequiredCapabilities("fs_child_dependency_rm", map[string]interface{}{"files": []string{"a"}}))
+	assert.Nil(t, lsm.RequiredCapabilities("volumes", nil))
+}
+
+func TestCapabilityGuardConcurrent(t *testing.T) {
+	var capCalls int32
+	var started = make(chan struct{}, 1)
+	var release = make(chan struct{})
+	var cb = goPluginCallBacks()
+	cb.Mgmt.Capabilities = func(system *lsm.System) (*lsm.Capabilities, error) {
+		atomic.AddInt32(&capCalls, 1)
+		started <- struct{}{}
+		<-release
+		return &lsm.Capabilities{Class: "Capabilities", Cap: capString(lsm.CapVolumeDelete)}, nil
+	}
+	cb.San.VolumeDelete = func(vol *lsm.Volume, flags uint64) (*string, error) {
+		return nil, nil
+	}
+
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	c.CapabilityGuardAdd()
+	var src = lsm.Volume{ID: "vol-01", SystemID: "go-01"}
+
+	var done = make(chan error)
+	go func() {
+		_, err := c.VolumeDelete(&src, true)
+		done <- err
+	}()
+	<-started
+
+	// Waiting on another caller's retrieval gives up when our context does
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.WithContext(ctx).VolumeDelete(&src, true)
+	assert.True(t, stderrors.Is(err, errors.ErrContextExpired))
+
+	close(release)
+	assert.Nil(t, <-done)
+	_, err = c.VolumeDelete(&src, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&capCalls))
+}
+
+func TestCapabilityIntrospection(t *testing.T) {
+	assert.Equal(t, "VOLUME_REPLICATE_MIRROR_SYNC", lsm.CapVolumeCReplicateMirrorSync.String())
+	assert.Equal(t, "VOLUME_READ_CACHE_POLICY_UPDATE_IMPACT_WRITE", lsm.VolReadCacheSetImpactWrite.String())
+	assert.Equal(t, "500", lsm.CapabilityType(500).String())
+
+	for _, cap := range lsm.CapabilityTypes() {
+		var text, err = cap.MarshalText()
+		assert.Nil(t, err)
+		assert.NotEqual(t, strconv.Itoa(int(cap)), string(text))
+
+		var parsed lsm.CapabilityType
+		assert.Nil(t, parsed.UnmarshalText(text))
+		assert.Equal(t, cap, parsed)
+	}
+
+	var a = lsm.Capabilities{Class: "Capabilities", Cap: capString(lsm.CapVolumes, lsm.CapVolumeCreate, lsm.CapDisks)}
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapVolumes, lsm.CapVolumeCreate, lsm.CapDisks}, a.Supported())
+
+	// Short or missing sets support nothing beyond their end
+	var short = lsm.Capabilities{Cap: "00"}
+	assert.False(t, short.IsSupported(lsm.CapDiskVpd83Get))
+	assert.False(t, short.IsSupportedSet([]lsm.CapabilityType{lsm.CapVolumes}))
+	assert.Nil(t, short.Supported())
+	var none *lsm.Capabilities
+	assert.False(t, none.IsSupported(lsm.CapVolumes))
+
+	var text, err = json.Marshal(a.Supported())
+	assert.Nil(t, err)
+	assert.Equal(t, `["VOLUMES","VOLUME_CREATE","DISKS"]`, string(text))
+	var parsed []lsm.CapabilityType
+	assert.Nil(t, json.Unmarshal(text, &parsed))
+	assert.Equal(t, a.Supported(), parsed)
+
+	// The wire form is unchanged
+	wire, err := json.Marshal(&a)
+	assert.Nil(t, err)
+	assert.Contains(t, string(wire), `"cap":"`+a.Cap+`"`)
+
+	var b = lsm.Capabilities{Class: "Capabilities", Cap: capString(lsm.CapVolumes, lsm.CapFs)}
+	onlyA, onlyB := lsm.CapabilitiesDiff(&a, &b)
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapVolumeCreate, lsm.CapDisks}, onlyA)
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapFs}, onlyB)
+	onlyA, onlyB = lsm.CapabilitiesDiff(&a, nil)
+	assert.Equal(t, a.Supported(), onlyA)
+	assert.Nil(t, onlyB)
+}
+
+func TestCapabilitiesBuilder(t *testing.T) {
+	var b lsm.CapabilitiesBuilder
+	var caps = b.Set(lsm.CapVolumes, lsm.CapDisks, lsm.CapFs).Clear(lsm.CapFs).Capabilities()
+	assert.Equal(t, "Capabilities", caps.Class)
+	assert.Equal(t, capString(lsm.CapVolumes, lsm.CapDisks), caps.Cap)
+
+	// Building from a base leaves it alone
+	var refined = lsm.NewCapabilitiesBuilder(caps).Set(lsm.CapVolumeThin).Clear(lsm.CapDisks).Capabilities()
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapVolumes, lsm.CapVolumeThin}, refined.Supported())
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapVolumes, lsm.CapDisks}, caps.Supported())
+	assert.True(t, lsm.NewCapabilitiesBuilder(nil).Set(600).Capabilities().IsSupported(600))
+
+	var cb = goPluginCallBacks()
+	cb.San.Volumes = func(search []string, flags uint64) ([]lsm.Volume, error) { return nil, nil }
+	cb.San.VolumeReplicate = func(optionalPool *lsm.Pool, repType lsm.VolumeReplicateType,
+		sourceVolume *lsm.Volume, name string, flags uint64) (*lsm.Volume, *string, error) {
+		return nil, nil, nil
+	}
+	cb.San.AccessGroupCreate = func(name string, initID string, initType lsm.InitiatorType,
+		system *lsm.System, flags uint64) (*lsm.AccessGroup, error) {
+		return nil, nil
+	}
+	cb.File.FsChildDepRm = func(fs *lsm.FileSystem, files []string, flags uint64) (*string, error) {
+		return nil, nil
+	}
+	cb.Nfs.FsExport = func(fs *lsm.FileSystem, exportPath *string, access *lsm.NfsAccess,
+		authType *string, options *string, flags uint64) (*lsm.NfsExport, error) {
+		return nil, nil
+	}
+
+	// Variants of a call aren't implied by it, unless it has no basic
+	// capability
+	var base = lsm.DeriveCapabilities(cb)
+	assert.Equal(t, []lsm.CapabilityType{lsm.CapVolumes, lsm.CapVolumeCReplicate, lsm.CapAccessGroupCreateWwpn,
+		lsm.CapAccessGroupCreateIscsiIqn, lsm.CapFsChildDepRm, lsm.CapFsExport}, base.Supported())
+
+	cb.San.AccessGroupInitAdd = func(ag *lsm.AccessGroup, initID string, initType lsm.InitiatorType,
+		flags uint64) (*lsm.AccessGroup, error) {
+		return nil, nil
+	}
+	cb.Cache.VolWriteCacheSet = func(volume *lsm.Volume, wcp lsm.WriteCachePolicy) error { return nil }
+	var derived = lsm.DeriveCapabilities(cb)
+	assert.True(t, derived.IsSupportedSet([]lsm.CapabilityType{lsm.CapAccessGroupInitiatorAddWwpn,
+		lsm.CapAccessGroupInitAddIscsiIqn, lsm.CapVolWriteCacheSetEnable, lsm.CapVolWriteCacheSetAuto,
+		lsm.CapVolWriteCacheSetDisabled}))
+	derived = lsm.NewCapabilitiesBuilder(derived).Clear(lsm.CapVolWriteCacheSetAuto).Capabilities()
+	assert.False(t, derived.IsSupported(lsm.CapVolWriteCacheSetAuto))
+	cb.San.AccessGroupInitAdd = nil
+	cb.Cache.VolWriteCacheSet = nil
+
+	cb.Mgmt.Capabilities = func(system *lsm.System) (*lsm.Capabilities, error) {
+		return lsm.NewCapabilitiesBuilder(base).Set(lsm.CapVolumeCReplicateClone).Capabilities(), nil
+	}
+	var c, err = lsm.Client(goPlugin(t, cb), PASSWORD, TMO)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	got, err := c.Capabilities(&lsm.System{ID: "go-01"})
+	assert.Nil(t, err)
+	assert.True(t, got.IsSupportedSet([]lsm.CapabilityType{lsm.CapVolumeCReplicate, lsm.CapVolumeCReplicateClone}))
+	assert.False(t, got.IsSupported(lsm.CapVolumeCReplicateCopy))
+}
+
 func setup() {
 	var c, _ = lsm.Client(URI, PASSWORD, TMO)
 
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: 0BSD
+
+package libstoragemgmt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	errors "github.com/libstorage/libstoragemgmt-golang/errors"
+)
+
+const headerLen = 10
+
+// Transport carries the JSON messages exchanged between a client and a
+// plugin, one complete message per Send and Recv.  The unix domain socket
+// used with lsmd is one implementation, it can be replaced to run a client
+// and a plugin in the same process, instrument the traffic or use some other
+// carrier.
+type Transport interface {
+	// Send writes one message.
+	Send(msg []byte) error
+
+	// Recv blocks until one complete message has been read.
+	Recv() ([]byte, error)
+
+	// SetDeadline causes pending and future Send and Recv calls to fail once
+	// t has passed, with an error implementing net.Error which reports
+	// Timeout() as true.  The zero value removes the deadline.
+	SetDeadline(t time.Time) error
+
+	// Close closes the transport, pending Send and Recv calls fail.
+	Close() error
+}
+
+// DefaultMaxFrameSize is the largest message accepted by default, enough for
+// listing hundreds of thousands of volumes.
+const DefaultMaxFrameSize = 256 * 1024 * 1024
+
+// FrameSizeLimiter is implemented by transports which bound the size of the
+// messages they accept.  A message exceeding the limit fails with an
+// errors.LsmError with code TransPortSerialization, without reading it.
+type FrameSizeLimiter interface {
+	MaxFrameSizeSet(size int)
+}
+
+// StreamReceiver is implemented by transports which can hand out the next
+// message as a stream, so large replies are decoded without holding both the
+// message and the result in memory.  The returned reader must be read to EOF
+// before the next message is received.
+type StreamReceiver interface {
+	RecvStream() (io.Reader, error)
+}
+
+// connTransport frames messages on a stream with a 10 digit length header,
+// as expected by lsmd and the plugins it runs.
+type connTransport struct {
+	c        net.Conn
+	r        *bufio.Reader
+	maxFrame int
+}
+
+// NewConnTransport returns a Transport which exchanges messages over c using
+// the libStorageMgmt framing.
+func NewConnTransport(c net.Conn) Transport {
+	return &connTransport{c: c, r: bufio.NewReader(c), maxFrame: DefaultMaxFrameSize}
+}
+
+// NewPipeTransport returns a connected pair of in-memory transports, one for
+// the client and one for the plugin.
+func NewPipeTransport() (client Transport, plugin Transport) {
+	c, p := net.Pipe()
+	return NewConnTransport(c), NewConnTransport(p)
+}
+
+func (t *connTransport) Send(msg []byte) error {
+	hdr := []byte(fmt.Sprintf("%0*d", headerLen, len(msg)))
+	buffers := net.Buffers{hdr, msg}
+	_, err := buffers.WriteTo(t.c)
+	return err
+}
+
+func (t *connTransport) Recv() ([]byte, error) {
+	msgLen, err := t.header()
+	if err != nil {
+		return make([]byte, 0), err
+	}
+
+	msgBuffer := make([]byte, msgLen)
+	_, readError := io.ReadFull(t.r, msgBuffer)
+	return msgBuffer, readError
+}
+
+func (t *connTransport) RecvStream() (io.Reader, error) {
+	msgLen, err := t.header()
+	if err != nil {
+		return nil, err
+	}
+	return &frame{r: t.r, remain: msgLen}, nil
+}
+
+// frame reads one message from the stream, ending the stream early is an
+// error.
+type frame struct {
+	r      io.Reader
+	remain int
+}
+
+func (f *frame) Read(p []byte) (int, error) {
+	if f.remain <= 0 {
+		return 0, io.EOF
+	}
+	if len(p) > f.remain {
+		p = p[:f.remain]
+	}
+
+	n, err := f.r.Read(p)
+	f.remain -= n
+	if err == io.EOF && f.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// header reads the length header of the next message and checks it against
+// the maximum frame size.
+func (t *connTransport) header() (int, error) {
+	var hdrLenBuf [headerLen]byte
+
+	if _, readError := io.ReadFull(t.r, hdrLenBuf[:]); readError != nil {
+		return 0, readError
+	}
+
+	msgLen, parseError := strconv.ParseUint(string(hdrLenBuf[:]), 10, 64)
+	if parseError != nil {
+		return 0, parseError
+	}
+
+	if msgLen > uint64(t.maxFrame) {
+		return 0, &errors.LsmError{
+			Code:    errors.TransPortSerialization,
+			Message: fmt.Sprintf("message of %d bytes exceeds maximum frame size of %d bytes", msgLen, t.maxFrame)}
+	}
+	return int(msgLen), nil
+}
+
+func (t *connTransport) MaxFrameSizeSet(size int) {
+	t.maxFrame = size
+}
+
+func (t *connTransport) SetDeadline(deadline time.Time) error {
+	return t.c.SetDeadline(deadline)
+}
+
+func (t *connTransport) Close() error {
+	return t.c.Close()
+}